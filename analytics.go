@@ -1,11 +1,18 @@
 package icarus
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
+
+	"github.com/mediocregopher/radix.v2/redis"
 )
 
 const AnalyticsBackoff = "analytics.backoff.%v"
@@ -15,6 +22,8 @@ const UserAgents = "analytics.useragent"
 const PageViews = "analytics.pv"
 const PageViewBucket = "analytics.pv_bucket"
 const PageViewPageBucket = "analytics.pv_bucket.%v"
+const UniqueVisitorBucket = "analytics.uv_bucket.%v"
+const PageUniqueVisitorBucket = "analytics.uv_bucket.%v.%v"
 const HistoricalReferrer = "imported from Google Analytics"
 const DirectReferrer = "DIRECT"
 const PageViewBonus = 60 * 60 * 24
@@ -45,33 +54,65 @@ var BotAgents = []string{
 	"mozilla/5.0 (compatible; baiduspider/2.0; +http://www.baidu.com/search/spider.html)",
 }
 
+// Use unique visitors rather than raw page views to rank trending pages.
+var trendByUniques = false
+
+// Proxies whose entries in X-Forwarded-For are skipped to find the reader.
+var trustedProxies = []*net.IPNet{}
+
+func ConfigAnalytics(cfg *Config) error {
+	trendByUniques = cfg.Analytics.TrendByUniques
+	trustedProxies = []*net.IPNet{}
+	for _, proxy := range cfg.Server.TrustedProxies {
+		if !strings.Contains(proxy, "/") {
+			if strings.Contains(proxy, ":") {
+				proxy += "/128"
+			} else {
+				proxy += "/32"
+			}
+		}
+		_, block, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy %v: %v", proxy, err)
+		}
+		trustedProxies = append(trustedProxies, block)
+	}
+	analyticsLimiter = NewRateLimiter("analytics", cfg.RateLimits["analytics"])
+	feedFetchLimiter = NewRateLimiter("feed_fetch", cfg.RateLimits["feed_fetch"])
+	campaignAllowlist = campaignSet(cfg.Analytics.Campaigns)
+	campaignSourceAllowlist = campaignSet(cfg.Analytics.CampaignSources)
+	return nil
+}
+
+// Build an allowlist of normalized campaign parameters, or nil if there are none.
+func campaignSet(values []string) map[string]bool {
+	if len(values) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(values))
+	for _, value := range values {
+		set[normalizeCampaign(value)] = true
+	}
+	return set
+}
+
 func CurrentTimestamp() int64 {
 	return time.Now().Unix()
 }
 
+// Limits analytics to one tracked event per IP per RateLimitPeriod by default.
+var analyticsLimiter = NewRateLimiter("analytics", RateLimitConfig{})
+
 func IsRateLimited(key string) bool {
-	script := `local current
-current = redis.call("incr",KEYS[1])
-if tonumber(current) == 1 then
-    redis.call("expire", KEYS[1], 60)
-end
-return current
-`
-	rc, err := GetRedisClient()
-	defer PutRedisClient(rc)
-	if err != nil {
-		log.Printf("error getting redis client: %v", err)
-		return true
-	}
-	ratelimited, err := rc.Cmd("EVAL", script, 2, key, RateLimitPeriod).Int()
-	if err != nil {
-		log.Printf("error checking ratelimit: %v", err)
-		return true
-	}
-	return ratelimited != 1
+	return analyticsLimiter.Limited(key)
 }
 
 func ShouldIgnore(p *Page, r *http.Request) bool {
+	return shouldIgnore(p, r, AnalyticsBackoff)
+}
+
+// Apply the bot and draft rules, rate limiting by IP against backoff.
+func shouldIgnore(p *Page, r *http.Request, backoff string) bool {
 	if strings.HasSuffix(p.Slug, ".png") || strings.HasSuffix(p.Slug, ".ico") {
 		return true
 	}
@@ -85,25 +126,124 @@ func ShouldIgnore(p *Page, r *http.Request) bool {
 	if p.Draft || strings.HasPrefix(lua, "reeder") || strings.Contains(lua, "bot") {
 		return true
 	}
-	ip := GetIP(r)
-	rlKey := fmt.Sprintf(AnalyticsBackoff, ip)
+	if OptedOut(r) || !HasConsent(r) {
+		return true
+	}
+	rlKey := fmt.Sprintf(backoff, RateLimitIP(r))
 	return IsRateLimited(rlKey)
 }
 
+/*
+Classify where a view came from.
+
+Views from tagged campaign links are attributed to their utm_source,
+otherwise to the host of the Referer header, with every Google
+domain lumped together as www.google.com.
+*/
 func Referrer(r *http.Request) string {
-	// if startswith("www.google") return "www.google.com"
-	// TODO: implement
-	return DirectReferrer
+	if c := CampaignFromRequest(r); c != nil && c.Source != "" {
+		return c.Source
+	}
+	u, err := url.Parse(r.Referer())
+	if err != nil || u.Host == "" {
+		return DirectReferrer
+	}
+	host := strings.ToLower(u.Host)
+	if strings.HasPrefix(host, "www.google.") {
+		return "www.google.com"
+	}
+	return host
+}
+
+var referrerClasses = []struct {
+	Class string
+	Hosts []string
+}{
+	{"search", []string{"www.google.com", "www.bing.com", "duckduckgo.com", "search.yahoo.com", "www.baidu.com"}},
+	{"aggregator", []string{"news.ycombinator.com", "www.reddit.com", "reddit.com", "lobste.rs", "digg.com"}},
+	{"social", []string{"t.co", "twitter.com", "www.facebook.com", "m.facebook.com", "www.linkedin.com", "lnkd.in"}},
+}
+
+/*
+Classify a referrer, as returned by Referrer, into direct, search,
+aggregator, social, campaign or other.
+*/
+func ReferrerClass(referrer string) string {
+	if referrer == DirectReferrer || referrer == HistoricalReferrer {
+		return "direct"
+	}
+	for _, rc := range referrerClasses {
+		for _, host := range rc.Hosts {
+			if referrer == host {
+				return rc.Class
+			}
+		}
+	}
+	if !strings.Contains(referrer, ".") {
+		// campaign sources like "newsletter" rather than hosts
+		return "campaign"
+	}
+	return "other"
+}
+
+// Top referrers for a page, or across the site if slug is empty.
+func TopReferrers(slug string, count int) ([]Counted, error) {
+	if slug == "" {
+		return TopCounts(Referrers, count)
+	}
+	return TopCounts(fmt.Sprintf(PageReferrers, slug), count)
 }
 
+func isTrustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	for _, block := range trustedProxies {
+		if parsed != nil && block.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Retrieve the reader's IP.
+
+Proxies append the address they received the request from to
+X-Forwarded-For, so entries are read from the end, skipping those
+appended by server.trusted_proxies, and the first one left is the
+reader. Anything before it was sent by the client and can't be trusted.
+*/
 func GetIP(r *http.Request) string {
-	if r.Header.Get("X-Forwarded-For") != "" {
-		return r.Header.Get("X-Forwarded-For")
+	ip := r.RemoteAddr
+	if fwd := r.Header["X-Forwarded-For"]; len(fwd) > 0 {
+		entries := strings.Split(strings.Join(fwd, ","), ",")
+		for i := len(entries) - 1; i >= 0; i-- {
+			ip = strings.TrimSpace(entries[i])
+			if !isTrustedProxy(ip) {
+				break
+			}
+		}
+	} else if r.Header.Get("X-Real-IP") != "" {
+		ip = r.Header.Get("X-Real-IP")
+	} else if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		ip = host
 	}
-	if r.Header.Get("X-Real-IP") != "" {
-		return r.Header.Get("X-Real-IP")
+	ip = strings.TrimSpace(ip)
+	if parsed := net.ParseIP(ip); parsed != nil {
+		return parsed.String()
 	}
-	return strings.Split(r.RemoteAddr, ":")[0]
+	return ip
+}
+
+/*
+Fingerprint a visitor for unique visitor counts.
+
+The fingerprint is a hash of the IP, user agent and day bucket, so
+the raw values are never stored and the same reader can't be
+correlated across days.
+*/
+func VisitorFingerprint(r *http.Request, bucket int) string {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%v|%v|%v", bucket, AnonymizedIP(r), r.UserAgent())))
+	return hex.EncodeToString(h[:16])
 }
 
 func Track(p *Page, r *http.Request) error {
@@ -113,31 +253,64 @@ func Track(p *Page, r *http.Request) error {
 		if err != nil {
 			return err
 		}
-		err = rc.Cmd("ZINCRBY", PageZsetByTrend, PageViewBonus, p.Slug).Err
+		bucket := timebucket(DaySeconds)
+
+		// unique visitors, estimated via HyperLogLog and bucketed by day
+		visitor := VisitorFingerprint(r, bucket)
+		err = rc.Cmd("PFADD", fmt.Sprintf(UniqueVisitorBucket, bucket), visitor).Err
+		if err != nil {
+			return err
+		}
+		isNew, err := rc.Cmd("PFADD", fmt.Sprintf(PageUniqueVisitorBucket, bucket, p.Slug), visitor).Int()
 		if err != nil {
 			return err
 		}
-		for _, tag := range p.Tags {
-			err := rc.Cmd("ZINCRBY", fmt.Sprintf(TagPagesZsetByTrend, tag), PageViewBonus, p.Slug).Err
+
+		if !trendByUniques || isNew == 1 {
+			err = rc.Cmd("ZINCRBY", PageZsetByTrend, PageViewBonus, p.Slug).Err
 			if err != nil {
 				return err
 			}
+			for _, tag := range p.Tags {
+				err := rc.Cmd("ZINCRBY", fmt.Sprintf(TagPagesZsetByTrend, tag), PageViewBonus, p.Slug).Err
+				if err != nil {
+					return err
+				}
+			}
 		}
 
-		// tracking referrers
-		referKeys := []string{
-			Referrers,
-			fmt.Sprintf(PageReferrers, p.Slug),
-		}
+		// tracking referrers, with made up campaign sources bounded
 		referrer := Referrer(r)
-		for _, key := range referKeys {
-			err := rc.Cmd("ZINCRBY", key, 1, referrer).Err
+		campaign := CampaignFromRequest(r)
+		if campaign != nil && campaign.Source != "" {
+			campaign.Source, err = boundCampaignSource(rc, campaign.Source)
+			if err != nil {
+				return err
+			}
+			referrer = campaign.Source
+		}
+		err = TrackReferrer(p, referrer, r)
+		if err != nil {
+			return err
+		}
+		err = TrackCoView(p, r)
+		if err != nil {
+			return err
+		}
+		if campaign != nil {
+			err := TrackCampaign(p, campaign)
+			if err != nil {
+				return err
+			}
+		}
+		if c := Country(r); c != "" {
+			err := TrackCountry(p, c)
 			if err != nil {
 				return err
 			}
 		}
 		// total pageviews by user agents
-		err = rc.Cmd("ZINCRBY", UserAgents, 1, r.UserAgent()).Err
+		err = rc.Cmd("ZINCRBY", UserAgents, 1, StoredUserAgent(r)).Err
 		if err != nil {
 			return err
 		}
@@ -147,7 +320,6 @@ func Track(p *Page, r *http.Request) error {
 			return err
 		}
 		// tracking pageviews, bucketed by day
-		bucket := timebucket(DaySeconds)
 		bucketKeys := []string{
 			PageViewBucket,
 			fmt.Sprintf(PageViewPageBucket, p.Slug),
@@ -158,12 +330,103 @@ func Track(p *Page, r *http.Request) error {
 				return err
 			}
 		}
-
+		// the view is already recorded, so live viewers missing it isn't fatal
+		err = PublishView(p, referrer)
+		if err != nil {
+			log.Printf("error publishing view of %v: %v", p.Slug, err)
+		}
 	}
 	return nil
 }
 
+// A member of a sorted set along with its count.
+type Counted struct {
+	Key   string
+	Count int
+}
+
+// Retrieve the count highest scoring members of a sorted set, or all if count is negative.
+func TopCounts(key string, count int) ([]Counted, error) {
+	rc, err := GetRedisClient()
+	defer PutRedisClient(rc)
+	if err != nil {
+		return []Counted{}, err
+	}
+	end := count - 1
+	if count < 0 {
+		end = -1
+	}
+	raw, err := rc.Cmd("ZREVRANGE", key, 0, end, "WITHSCORES").List()
+	if err != nil {
+		return []Counted{}, err
+	}
+	counts := make([]Counted, 0, len(raw)/2)
+	for i := 0; i+1 < len(raw); i += 2 {
+		c, err := strconv.ParseFloat(raw[i+1], 64)
+		if err != nil {
+			log.Printf("error translating count for %v to int: %v", raw[i], err)
+			continue
+		}
+		counts = append(counts, Counted{Key: raw[i], Count: int(c)})
+	}
+	return counts, nil
+}
+
+// Page views and estimated unique visitors for one day.
+type DayStats struct {
+	Bucket    int
+	PageViews int
+	Uniques   int
+}
+
+func (ds *DayStats) Date() time.Time {
+	return BucketDate(ds.Bucket)
+}
+
+/*
+Retrieve daily page views and unique visitors for the trailing
+number of days, oldest first.
+
+An empty slug returns the site-wide numbers.
+*/
+func DailyStats(slug string, days int) ([]*DayStats, error) {
+	rc, err := GetRedisClient()
+	defer PutRedisClient(rc)
+	if err != nil {
+		return []*DayStats{}, err
+	}
+	pvKey := PageViewBucket
+	if slug != "" {
+		pvKey = fmt.Sprintf(PageViewPageBucket, slug)
+	}
+	today := timebucket(DaySeconds)
+	stats := make([]*DayStats, 0, days)
+	for bucket := today - days + 1; bucket <= today; bucket++ {
+		ds := &DayStats{Bucket: bucket}
+		resp := rc.Cmd("ZSCORE", pvKey, bucket)
+		if !resp.IsType(redis.Nil) {
+			pv, err := resp.Float64()
+			if err != nil {
+				return stats, err
+			}
+			ds.PageViews = int(pv)
+		}
+		uvKey := fmt.Sprintf(UniqueVisitorBucket, bucket)
+		if slug != "" {
+			uvKey = fmt.Sprintf(PageUniqueVisitorBucket, bucket, slug)
+		}
+		ds.Uniques, err = rc.Cmd("PFCOUNT", uvKey).Int()
+		if err != nil {
+			return stats, err
+		}
+		stats = append(stats, ds)
+	}
+	return stats, nil
+}
+
+// Bucket the current time by period, aligned to the site's timezone.
 func timebucket(period int) int {
-	now := CurrentTimestamp()
-	return int(now / int64(period))
+	now := time.Now().In(siteLocation)
+	_, offset := now.Zone()
+	return int((now.Unix() + int64(offset)) / int64(period))
 }
@@ -0,0 +1,119 @@
+// Tracking which pages link to each other, to show pages linking to a page.
+package icarus
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mediocregopher/radix.v2/redis"
+)
+
+// Set of slugs a page links to.
+const PageLinks = "page_links.%v"
+
+// Slugs of the pages linking to a page, scored by their publication date.
+const PageBacklinks = "backlinks.%v"
+
+var linkDomain = ""
+
+func ConfigBacklinks(cfg *Config) error {
+	linkDomain = strings.ToLower(cfg.Server.Domain)
+	return nil
+}
+
+// The slugs of other pages linked to from the page's content.
+func LinkedSlugs(p *Page) []string {
+	seen := make(map[string]bool)
+	slugs := []string{}
+	for _, m := range hrefAttr.FindAllStringSubmatch(p.Content, -1) {
+		slug, ok := internalSlug(linkDomain, m[1])
+		if !ok || slug == p.Slug || seen[slug] {
+			continue
+		}
+		seen[slug] = true
+		slugs = append(slugs, slug)
+	}
+	sort.Strings(slugs)
+	return slugs
+}
+
+/*
+Record the pages p links to, replacing the links recorded when it was
+last synced. Drafts are recorded as linking to nothing, so they don't
+appear among other pages' backlinks, which is also how a page's links
+are removed: links recorded under a page's old slug stay until that
+slug is synced as a draft.
+
+The old links are replaced in one transaction, so a concurrent sync of
+the same page can't leave links from both.
+*/
+func RegisterLinks(p *Page) error {
+	rc, err := GetRedisClient()
+	defer PutRedisClient(rc)
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf(PageLinks, p.Slug)
+	err = rc.Cmd("WATCH", key).Err
+	if err != nil {
+		return err
+	}
+	defer rc.Cmd("UNWATCH")
+	previous, err := rc.Cmd("SMEMBERS", key).List()
+	if err != nil {
+		return err
+	}
+	slugs := []string{}
+	if !p.Draft {
+		slugs = LinkedSlugs(p)
+	}
+
+	err = rc.Cmd("MULTI").Err
+	if err != nil {
+		return err
+	}
+	err = queueLinks(rc, p, previous, slugs)
+	if err != nil {
+		rc.Cmd("DISCARD")
+		return err
+	}
+	resp := rc.Cmd("EXEC")
+	if resp.Err != nil {
+		return resp.Err
+	}
+	if resp.IsType(redis.Nil) {
+		return fmt.Errorf("links for %v changed while syncing it, sync it again", p.Slug)
+	}
+	return nil
+}
+
+// Queue replacing the links p previously had with slugs inside a transaction.
+func queueLinks(rc *redis.Client, p *Page, previous []string, slugs []string) error {
+	key := fmt.Sprintf(PageLinks, p.Slug)
+	for _, slug := range previous {
+		err := rc.Cmd("ZREM", fmt.Sprintf(PageBacklinks, slug), p.Slug).Err
+		if err != nil {
+			return err
+		}
+	}
+	err := rc.Cmd("DEL", key).Err
+	if err != nil {
+		return err
+	}
+	for _, slug := range slugs {
+		err := rc.Cmd("ZADD", fmt.Sprintf(PageBacklinks, slug), p.PubDate().Unix(), p.Slug).Err
+		if err != nil {
+			return err
+		}
+	}
+	if len(slugs) > 0 {
+		return rc.Cmd("SADD", key, slugs).Err
+	}
+	return nil
+}
+
+// Pages linking to p, most recently published first.
+func Backlinks(p *Page, offset int, count int) ([]*Page, error) {
+	return PagesForList(fmt.Sprintf(PageBacklinks, p.Slug), offset, count, true)
+}
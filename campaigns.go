@@ -0,0 +1,191 @@
+// Tracking views from links tagged with UTM campaign parameters.
+package icarus
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"github.com/mediocregopher/radix.v2/redis"
+)
+
+const Campaigns = "analytics.campaign"
+const PageCampaigns = "analytics.campaign.%v"
+const CampaignSources = "analytics.campaign_source.%v"
+const AllCampaignSources = "analytics.campaign_sources"
+const NoCampaign = "(none)"
+
+// Campaigns and sources past their allowlist, or MaxCampaigns without one, are counted as OtherCampaign.
+const OtherCampaign = "(other)"
+const MaxCampaigns = 500
+const MaxCampaignLength = 64
+
+// Nil unless Analytics.Campaigns is configured, in which case only those are tracked.
+var campaignAllowlist map[string]bool
+
+// Nil unless Analytics.CampaignSources is configured, in which case only those are tracked.
+var campaignSourceAllowlist map[string]bool
+
+// The utm_ parameters from a tagged link.
+type Campaign struct {
+	Source  string
+	Medium  string
+	Name    string
+	Term    string
+	Content string
+}
+
+/*
+Normalize a UTM parameter, since they come from whoever wrote the link:
+lowercased, with whitespace collapsed to dashes, anything other than
+letters, digits, ".", "-" and "_" dropped, and cut to MaxCampaignLength.
+*/
+func normalizeCampaign(s string) string {
+	s = strings.Join(strings.Fields(strings.ToLower(s)), "-")
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.' || r == '-' || r == '_' {
+			return r
+		}
+		return -1
+	}, s)
+	if runes := []rune(s); len(runes) > MaxCampaignLength {
+		s = string(runes[:MaxCampaignLength])
+	}
+	return s
+}
+
+// Parse UTM parameters from a request, returning nil if there are none.
+func CampaignFromRequest(r *http.Request) *Campaign {
+	q := r.URL.Query()
+	c := &Campaign{
+		Source:  normalizeCampaign(q.Get("utm_source")),
+		Medium:  normalizeCampaign(q.Get("utm_medium")),
+		Name:    normalizeCampaign(q.Get("utm_campaign")),
+		Term:    normalizeCampaign(q.Get("utm_term")),
+		Content: normalizeCampaign(q.Get("utm_content")),
+	}
+	if c.Source == "" && c.Name == "" {
+		return nil
+	}
+	if c.Name == "" {
+		c.Name = NoCampaign
+	}
+	return c
+}
+
+// The source and medium, as Google Analytics displays them.
+func (c *Campaign) SourceMedium() string {
+	if c.Medium == "" {
+		return c.Source
+	}
+	return fmt.Sprintf("%v / %v", c.Source, c.Medium)
+}
+
+/*
+Bound a campaign parameter so made up values can't fill Redis: values
+not on the allowlist, or new values once MaxCampaigns are counted in
+key if there's no allowlist, become OtherCampaign.
+*/
+func boundCampaign(rc *redis.Client, key string, allowlist map[string]bool, value string) (string, error) {
+	if allowlist != nil {
+		if !allowlist[value] {
+			return OtherCampaign, nil
+		}
+		return value, nil
+	}
+	resp := rc.Cmd("ZSCORE", key, value)
+	if resp.Err != nil {
+		return "", resp.Err
+	}
+	if !resp.IsType(redis.Nil) {
+		return value, nil
+	}
+	tracked, err := rc.Cmd("ZCARD", key).Int()
+	if err != nil {
+		return "", err
+	}
+	if tracked >= MaxCampaigns {
+		return OtherCampaign, nil
+	}
+	return value, nil
+}
+
+/*
+Bound a campaign's utm_source before it's recorded as a referrer, in
+the same way as campaign names, against the sources counted in
+AllCampaignSources. Sources which are blocklisted or marked as
+referrer spam are counted as OtherCampaign too.
+*/
+func boundCampaignSource(rc *redis.Client, source string) (string, error) {
+	if IsBlockedReferrer(source) {
+		return OtherCampaign, nil
+	}
+	spam, err := rc.Cmd("SISMEMBER", ReferrerSpam, source).Int()
+	if err != nil {
+		return "", err
+	}
+	if spam == 1 {
+		return OtherCampaign, nil
+	}
+	return boundCampaign(rc, AllCampaignSources, campaignSourceAllowlist, source)
+}
+
+/*
+Record a view of a page from a campaign. Campaigns not on the allowlist,
+or new campaigns once MaxCampaigns are tracked, are counted together as
+OtherCampaign, as are sources and mediums past MaxCampaigns for a
+campaign. The source should already be bounded by boundCampaignSource.
+*/
+func TrackCampaign(p *Page, c *Campaign) error {
+	rc, err := GetRedisClient()
+	defer PutRedisClient(rc)
+	if err != nil {
+		return err
+	}
+	name := c.Name
+	if name != NoCampaign {
+		name, err = boundCampaign(rc, Campaigns, campaignAllowlist, name)
+		if err != nil {
+			return err
+		}
+	}
+	counts := map[string]string{
+		Campaigns:                          name,
+		fmt.Sprintf(PageCampaigns, p.Slug): name,
+	}
+	if c.Source != "" {
+		counts[AllCampaignSources] = c.Source
+	}
+	// sources aren't broken down for campaigns lumped together
+	if name != OtherCampaign {
+		sources := fmt.Sprintf(CampaignSources, name)
+		member, err := boundCampaign(rc, sources, nil, c.SourceMedium())
+		if err != nil {
+			return err
+		}
+		counts[sources] = member
+	}
+	for key, member := range counts {
+		err := rc.Cmd("ZINCRBY", key, 1, member).Err
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Top campaigns for a page, or across the site if slug is empty.
+*/
+func TopCampaigns(slug string, count int) ([]Counted, error) {
+	if slug == "" {
+		return TopCounts(Campaigns, count)
+	}
+	return TopCounts(fmt.Sprintf(PageCampaigns, slug), count)
+}
+
+// Top sources and mediums for a campaign.
+func TopCampaignSources(name string, count int) ([]Counted, error) {
+	return TopCounts(fmt.Sprintf(CampaignSources, name), count)
+}
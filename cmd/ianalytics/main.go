@@ -0,0 +1,293 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/lethain/icarus"
+)
+
+var configPath = flag.String("config", "config.json", "path to configuration file, defaults to config.json")
+var days = flag.Int("days", 7, "number of trailing days (or periods) to report on")
+var count = flag.Int("count", 10, "number of entries to show for top lists")
+var period = flag.String("period", "day", "report by day, week, month or year")
+
+func reportPeriod(slug string) error {
+	stats, err := icarus.RollupStats(slug, *period, *days)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%-12v %10v %10v\n", *period, "views", "uniques")
+	for _, ps := range stats {
+		fmt.Printf("%-12v %10v %10v\n", ps.Label, ps.PageViews, ps.Uniques)
+	}
+	return nil
+}
+
+func report(slugs []string) error {
+	if len(slugs) == 0 {
+		slugs = []string{""}
+	}
+	for _, slug := range slugs {
+		if slug == "" {
+			fmt.Println("site-wide")
+		} else {
+			fmt.Println(slug)
+		}
+		if *period != "day" {
+			err := reportPeriod(slug)
+			if err != nil {
+				return err
+			}
+			fmt.Println()
+			continue
+		}
+		stats, err := icarus.DailyStats(slug, *days)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%-12v %10v %10v\n", "date", "views", "uniques")
+		for _, ds := range stats {
+			fmt.Printf("%-12v %10v %10v\n", ds.Date().Format("2006-01-02"), ds.PageViews, ds.Uniques)
+		}
+		fmt.Println()
+	}
+	return nil
+}
+
+func importGA(files []string) error {
+	if len(files) == 0 {
+		return fmt.Errorf("must specify at least one export to import")
+	}
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		summary, err := icarus.ImportGoogleAnalytics(f)
+		f.Close()
+		if err != nil {
+			log.Printf("failed importing %v: %v", file, err)
+			continue
+		}
+		log.Printf("imported %v: %v", file, summary)
+	}
+	return nil
+}
+
+func outbound(slugs []string) error {
+	if len(slugs) == 0 {
+		slugs = []string{""}
+	}
+	for _, slug := range slugs {
+		if slug == "" {
+			fmt.Println("site-wide outbound hosts")
+		} else {
+			fmt.Printf("outbound links from %v\n", slug)
+		}
+		links, err := icarus.TopOutbound(slug, *count)
+		if err != nil {
+			return err
+		}
+		for _, link := range links {
+			fmt.Printf("%10v %v\n", link.Count, link.Key)
+		}
+		fmt.Println()
+	}
+	return nil
+}
+
+func referrers(slugs []string) error {
+	if len(slugs) == 0 {
+		slugs = []string{""}
+	}
+	for _, slug := range slugs {
+		if slug == "" {
+			fmt.Println("site-wide referrers")
+		} else {
+			fmt.Printf("referrers for %v\n", slug)
+		}
+		counts, err := icarus.TopReferrers(slug, *count)
+		if err != nil {
+			return err
+		}
+		for _, c := range counts {
+			fmt.Printf("%10v %v\n", c.Count, c.Key)
+		}
+		fmt.Println()
+	}
+	return nil
+}
+
+func campaigns(slugs []string) error {
+	if len(slugs) == 0 {
+		slugs = []string{""}
+	}
+	for _, slug := range slugs {
+		if slug == "" {
+			fmt.Println("site-wide campaigns")
+		} else {
+			fmt.Printf("campaigns for %v\n", slug)
+		}
+		counts, err := icarus.TopCampaigns(slug, *count)
+		if err != nil {
+			return err
+		}
+		for _, c := range counts {
+			fmt.Printf("%10v %v\n", c.Count, c.Key)
+			sources, err := icarus.TopCampaignSources(c.Key, *count)
+			if err != nil {
+				return err
+			}
+			for _, s := range sources {
+				fmt.Printf("%10v   %v\n", s.Count, s.Key)
+			}
+		}
+		fmt.Println()
+	}
+	return nil
+}
+
+func feeds(names []string) error {
+	if len(names) == 0 {
+		names = []string{icarus.SiteFeed}
+	}
+	for _, name := range names {
+		stats, err := icarus.FeedSubscribers(name, *days)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("subscribers for %v\n", name)
+		fmt.Printf("%-12v %10v %10v %10v %10v\n", "date", "fetches", "aggregated", "direct", "estimate")
+		for _, fs := range stats {
+			fmt.Printf("%-12v %10v %10v %10v %10v\n", fs.Date().Format("2006-01-02"), fs.Fetches, fs.Aggregated, fs.Direct, fs.Estimate())
+		}
+		fmt.Println()
+	}
+	return nil
+}
+
+func countries(slugs []string) error {
+	if len(slugs) == 0 {
+		slugs = []string{""}
+	}
+	for _, slug := range slugs {
+		if slug == "" {
+			fmt.Printf("site-wide countries over %v days\n", *days)
+		} else {
+			fmt.Printf("countries for %v\n", slug)
+		}
+		counts, err := icarus.TopCountries(slug, *days, *count)
+		if err != nil {
+			return err
+		}
+		for _, c := range counts {
+			fmt.Printf("%10v %v\n", c.Count, c.Key)
+		}
+		fmt.Println()
+	}
+	return nil
+}
+
+func reads(slugs []string) error {
+	if len(slugs) == 0 {
+		return fmt.Errorf("must specify at least one slug")
+	}
+	for _, slug := range slugs {
+		rs, err := icarus.PageReadStats(slug)
+		if err != nil {
+			return err
+		}
+		fmt.Println(slug)
+		fmt.Printf("%-12v %10v\n", "beacons", rs.Beacons)
+		fmt.Printf("%-12v %9.1f%%\n", "completed", rs.CompletionRate*100)
+		fmt.Printf("%-12v %9vs\n", "median time", rs.MedianSeconds)
+		for depth := 0; depth <= 100; depth += 25 {
+			fmt.Printf("%-12v %10v\n", fmt.Sprintf("depth %v%%", depth), rs.Depths[depth])
+		}
+		fmt.Println()
+	}
+	return nil
+}
+
+func purgeReferrers() error {
+	purged, err := icarus.PurgeSpamReferrers()
+	if err != nil {
+		return err
+	}
+	for _, referrer := range purged {
+		log.Printf("purged %v", referrer)
+	}
+	log.Printf("purged %v spam referrers", len(purged))
+	return nil
+}
+
+func main() {
+	flag.Parse()
+	args := flag.Args()
+
+	cfg, err := icarus.NewConfigFromFile(*configPath)
+	if err != nil {
+		log.Fatalf("error loading config: %v", err)
+	}
+	err = icarus.ConfigRedis(cfg)
+	if err != nil {
+		log.Fatalf("failed configuring redis: %v", err)
+	}
+	err = icarus.ConfigTimezone(cfg)
+	if err != nil {
+		log.Fatalf("failed configuring timezone: %v", err)
+	}
+	err = icarus.ConfigAnalytics(cfg)
+	if err != nil {
+		log.Fatalf("failed configuring analytics: %v", err)
+	}
+	err = icarus.ConfigRollups(cfg)
+	if err != nil {
+		log.Fatalf("failed configuring rollups: %v", err)
+	}
+	err = icarus.ConfigPrivacy(cfg)
+	if err != nil {
+		log.Fatalf("failed configuring privacy: %v", err)
+	}
+	err = icarus.ConfigReferrerSpam(cfg)
+	if err != nil {
+		log.Fatalf("failed configuring referrer spam: %v", err)
+	}
+	if len(args) == 0 {
+		log.Fatalf("must specify a command: report [slug ...], outbound [slug ...], referrers [slug ...], campaigns [slug ...], feeds [feed ...], countries [slug ...], reads slug [...], rollup, purge, purge-referrers, migrate-timezone or import file.csv [...]")
+	}
+	switch args[0] {
+	case "report":
+		err = report(args[1:])
+	case "outbound":
+		err = outbound(args[1:])
+	case "referrers":
+		err = referrers(args[1:])
+	case "campaigns":
+		err = campaigns(args[1:])
+	case "feeds":
+		err = feeds(args[1:])
+	case "countries":
+		err = countries(args[1:])
+	case "reads":
+		err = reads(args[1:])
+	case "rollup":
+		err = icarus.Rollup()
+	case "purge":
+		err = icarus.PurgeAnalytics()
+	case "purge-referrers":
+		err = purgeReferrers()
+	case "migrate-timezone":
+		err = icarus.MigrateTimezone()
+	case "import":
+		err = importGA(args[1:])
+	default:
+		log.Fatalf("unknown command %v", args[0])
+	}
+	if err != nil {
+		log.Fatalf("failed running %v: %v", args[0], err)
+	}
+}
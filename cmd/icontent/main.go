@@ -2,8 +2,10 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"os"
 
 	"github.com/lethain/icarus"
 )
@@ -12,14 +14,36 @@ var asMarkdown = flag.Bool("markdown", false, "Force evaluating as Markdown.")
 var asHTML = flag.Bool("html", false, "Force evaluating as HTML.")
 var configPath = flag.String("config", "config.json", "path to configuration file, defaults to config.json")
 
-func render(filename string, content string) (*icarus.Page, error) {
+func render(filename string, content string, wikiPages icarus.WikiPages) (*icarus.Page, error) {
 	if *asMarkdown {
-		return icarus.RenderMarkdown(content)
+		return icarus.RenderMarkdown(content, wikiPages)
 	}
 	if *asHTML {
 		return icarus.RenderHTML(content)
 	}
-	return icarus.Render(filename, content)
+	return icarus.Render(filename, content, wikiPages)
+}
+
+/*
+Check each file, printing diagnostics as file:line:column: message,
+and exit non-zero if there were any.
+*/
+func lint(cfg *icarus.Config, files []string) {
+	if len(files) == 0 {
+		log.Fatalf("must specify at least one file to lint")
+	}
+	// links can still be checked against the files being linted
+	err := icarus.ConfigRedis(cfg)
+	if err != nil {
+		log.Printf("failed configuring redis, not checking links against loaded pages: %v", err)
+	}
+	diagnostics := icarus.LintFiles(cfg, files)
+	for _, d := range diagnostics {
+		fmt.Println(d)
+	}
+	if len(diagnostics) > 0 {
+		os.Exit(1)
+	}
 }
 
 func main() {
@@ -31,11 +55,31 @@ func main() {
 	if err != nil {
 		log.Fatalf("failed configuring redis: %v", err)
 	}
+	err = icarus.ConfigTimezone(cfg)
+	if err != nil {
+		log.Fatalf("failed configuring timezone: %v", err)
+	}
+	if len(files) > 0 && files[0] == "lint" {
+		lint(cfg, files[1:])
+		return
+	}
 	log.Printf("loaded configuration: %v", cfg)
 	err = icarus.ConfigRedis(cfg)
 	if err != nil {
 		log.Fatalf("failed configuring redis: %v", err)
 	}
+	err = icarus.ConfigMarkdown(cfg)
+	if err != nil {
+		log.Fatalf("failed configuring markdown: %v", err)
+	}
+	err = icarus.ConfigImages(cfg)
+	if err != nil {
+		log.Fatalf("failed configuring images: %v", err)
+	}
+	err = icarus.ConfigBacklinks(cfg)
+	if err != nil {
+		log.Fatalf("failed configuring backlinks: %v", err)
+	}
 	err = icarus.ConfigSearch(cfg)
 	if err != nil {
 		log.Fatalf("failed configuring search: %v", err)
@@ -44,18 +88,35 @@ func main() {
 	if len(files) == 0 {
 		log.Fatalf("must specify at least one file to load")
 	}
-	pages := make([]*icarus.Page, 0, len(files))
+	contents := make(map[string]string, len(files))
+	wikiPages := icarus.WikiPages{}
 	for _, file := range files {
 		content, err := ioutil.ReadFile(file)
 		if err != nil {
 			log.Printf("failed to read %v: %v", file, err)
 			continue
 		}
-		page, err := render(file, string(content))
+		contents[file] = string(content)
+		// so wiki links can point at pages loaded alongside them
+		if page, _, err := icarus.ReadHeaders(string(content)); err == nil && page.Slug != "" {
+			wikiPages.Add(page.Slug, page.Title)
+		}
+	}
+	pages := make([]*icarus.Page, 0, len(files))
+	for _, file := range files {
+		content, ok := contents[file]
+		if !ok {
+			continue
+		}
+		page, err := render(file, content, wikiPages)
 		if err != nil {
 			log.Printf("failed to render %v: %v", file, err)
 			continue
 		}
+		err = icarus.ProcessImages(page)
+		if err != nil {
+			log.Printf("loading %v with some images unprocessed: %v", file, err)
+		}
 		pages = append(pages, page)
 	}
 
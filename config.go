@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"strings"
 )
 
 type RSSConfig struct {
@@ -19,6 +20,8 @@ type ServerConfig struct {
 	Loc    string
 	Proto  string
 	Domain string
+	// addresses or CIDRs of the proxies in front of Icarus
+	TrustedProxies []string `json:"trusted_proxies"`
 }
 
 // .BlogName -> .Blog.Name
@@ -30,6 +33,7 @@ type BlogConfig struct {
 	PagesInPaginator int    `json:"pages_in_paginator"`
 	TemplateDir      string `json:"template_dir"`
 	StaticDir        string `json:"static_dir"`
+	Timezone         string `json:"timezone"`
 }
 
 type RedisConfig struct {
@@ -38,11 +42,56 @@ type RedisConfig struct {
 	PoolSize int
 }
 
+type AnalyticsConfig struct {
+	TrendByUniques    bool     `json:"trend_by_uniques"`
+	RetentionDays     int      `json:"retention_days"`
+	RollupPeriod      int      `json:"rollup_period"`
+	TrackOutbound     bool     `json:"track_outbound"`
+	TrackSessions     bool     `json:"track_sessions"`
+	LiveToken         string   `json:"live_token"`
+	ReferrerBlocklist string   `json:"referrer_blocklist"`
+	VerifyReferrers   bool     `json:"verify_referrers"`
+	GeoIPDatabase     string   `json:"geoip_database"`
+	Campaigns         []string `json:"campaigns"`
+	CampaignSources   []string `json:"campaign_sources"`
+}
+
+// AnonymizeIPs is "truncate", "hash" or empty to store IPs as-is.
+type PrivacyConfig struct {
+	AnonymizeIPs     string `json:"anonymize_ips"`
+	ReduceUserAgents bool   `json:"reduce_user_agents"`
+	RequireConsent   bool   `json:"require_consent"`
+}
+
+type MarkdownConfig struct {
+	LineNumbers    bool `json:"line_numbers"`
+	HeadingAnchors bool `json:"heading_anchors"`
+}
+
+// Widths of the variants generated for images referenced by pages.
+type ImagesConfig struct {
+	Widths         []int
+	ThumbnailWidth int `json:"thumbnail_width"`
+	Quality        int
+}
+
+// Window is in seconds, and Budget is the requests allowed per window.
+type RateLimitConfig struct {
+	Window   int
+	Budget   int
+	FailOpen bool `json:"fail_open"`
+}
+
 type Config struct {
-	Server ServerConfig
-	RSS    RSSConfig
-	Blog   BlogConfig
-	Redis  RedisConfig
+	Server     ServerConfig
+	RSS        RSSConfig
+	Blog       BlogConfig
+	Redis      RedisConfig
+	Analytics  AnalyticsConfig
+	Privacy    PrivacyConfig
+	Markdown   MarkdownConfig
+	Images     ImagesConfig
+	RateLimits map[string]RateLimitConfig `json:"rate_limits"`
 }
 
 func (cfg *Config) BaseURL() string {
@@ -50,6 +99,14 @@ func (cfg *Config) BaseURL() string {
 
 }
 
+// Make a URL absolute, if it's a path on this site.
+func (cfg *Config) AbsoluteURL(url string) string {
+	if strings.HasPrefix(url, "/") && !strings.HasPrefix(url, "//") {
+		return cfg.BaseURL() + url[1:]
+	}
+	return url
+}
+
 // Build a new configuration file from disk.
 func NewConfigFromFile(path string) (*Config, error) {
 	file, err := ioutil.ReadFile(path)
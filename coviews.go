@@ -0,0 +1,127 @@
+// Recommending pages which are read together in the same session.
+package icarus
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+const SessionCookie = "icarus_session"
+const SessionPages = "analytics.session.%v"
+const CoViewedPages = "coviewed_pages.%v"
+const SessionExpire = 60 * 30
+
+// Sessions viewing more pages than this are probably crawlers.
+const MaxSessionPages = 50
+
+var trackSessions = false
+
+func ConfigSessions(cfg *Config) error {
+	trackSessions = cfg.Analytics.TrackSessions
+	return nil
+}
+
+/*
+Ensure the reader has an anonymous session cookie, returning its id.
+
+The cookie is also attached to r so a session's first view is tracked.
+Returns an empty id if sessions are disabled or the reader hasn't
+consented to tracking.
+*/
+func EnsureSession(w http.ResponseWriter, r *http.Request) string {
+	if !trackSessions || OptedOut(r) || !HasConsent(r) {
+		return ""
+	}
+	if c, err := r.Cookie(SessionCookie); err == nil && c.Value != "" {
+		return c.Value
+	}
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		log.Printf("error generating session id: %v", err)
+		return ""
+	}
+	c := &http.Cookie{
+		Name:     SessionCookie,
+		Value:    hex.EncodeToString(buf),
+		Path:     "/",
+		HttpOnly: true,
+	}
+	http.SetCookie(w, c)
+	r.AddCookie(c)
+	return c.Value
+}
+
+/*
+Record a view of p within the reader's session, scoring it as read
+together with every other page already read in that session.
+*/
+func TrackCoView(p *Page, r *http.Request) error {
+	if !trackSessions {
+		return nil
+	}
+	c, err := r.Cookie(SessionCookie)
+	if err != nil || c.Value == "" {
+		return nil
+	}
+	rc, err := GetRedisClient()
+	defer PutRedisClient(rc)
+	if err != nil {
+		return err
+	}
+	sessionKey := fmt.Sprintf(SessionPages, c.Value)
+	others, err := rc.Cmd("SMEMBERS", sessionKey).List()
+	if err != nil {
+		return err
+	}
+	if len(others) >= MaxSessionPages {
+		return nil
+	}
+	added, err := rc.Cmd("SADD", sessionKey, p.Slug).Int()
+	if err != nil {
+		return err
+	}
+	err = rc.Cmd("EXPIRE", sessionKey, SessionExpire).Err
+	if err != nil || added == 0 {
+		return err
+	}
+	for _, other := range others {
+		err := rc.Cmd("ZINCRBY", fmt.Sprintf(CoViewedPages, p.Slug), 1, other).Err
+		if err != nil {
+			return err
+		}
+		err = rc.Cmd("ZINCRBY", fmt.Sprintf(CoViewedPages, other), 1, p.Slug).Err
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Pages most often read in the same session as p.
+func AlsoReadPages(p *Page, offset int, count int) ([]*Page, error) {
+	return PagesForList(fmt.Sprintf(CoViewedPages, p.Slug), offset, count, true)
+}
+
+// Stop recommending p alongside other pages, e.g. when it becomes a draft.
+func UnregisterCoViews(p *Page) error {
+	rc, err := GetRedisClient()
+	defer PutRedisClient(rc)
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf(CoViewedPages, p.Slug)
+	others, err := rc.Cmd("ZRANGE", key, 0, -1).List()
+	if err != nil {
+		return err
+	}
+	for _, other := range others {
+		err := rc.Cmd("ZREM", fmt.Sprintf(CoViewedPages, other), p.Slug).Err
+		if err != nil {
+			return err
+		}
+	}
+	return rc.Cmd("DEL", key).Err
+}
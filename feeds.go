@@ -6,7 +6,7 @@ import (
 )
 
 func BuildAtomFeed(cfg *Config, ps []*Page) (*feeds.Feed, error) {
-	now := time.Now()
+	now := SiteTime(time.Now())
 	feed := &feeds.Feed{
 		Title:   cfg.Blog.Name,
 		Link:    &feeds.Link{Href: cfg.BaseURL()},
@@ -17,7 +17,8 @@ func BuildAtomFeed(cfg *Config, ps []*Page) (*feeds.Feed, error) {
 	for _, p := range ps {
 		feed.Items = append(feed.Items, &feeds.Item{
 			Title:       p.Title,
-			Description: p.Content,
+			Description: p.Summary,
+			Content:     p.Content,
 			Created:     p.PubDate(),
 			Link:        &feeds.Link{Href: cfg.BaseURL() + p.Slug + "/"},
 		})
@@ -0,0 +1,109 @@
+// Counting readers by country from a local MaxMind database.
+package icarus
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+const CountryViews = "analytics.country.%v"
+const PageCountryViews = "analytics.country_page.%v"
+
+// Nil unless Analytics.GeoIPDatabase is configured.
+var geoipDB *maxminddb.Reader
+
+type geoipRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+func ConfigGeoIP(cfg *Config) error {
+	if cfg.Analytics.GeoIPDatabase == "" {
+		return nil
+	}
+	db, err := maxminddb.Open(cfg.Analytics.GeoIPDatabase)
+	if err != nil {
+		return fmt.Errorf("failed opening geoip database %v: %v", cfg.Analytics.GeoIPDatabase, err)
+	}
+	geoipDB = db
+	return nil
+}
+
+/*
+Look up the ISO country code for the request's IP, returning an
+empty string if there is no database configured or no match.
+*/
+func Country(r *http.Request) string {
+	if geoipDB == nil {
+		return ""
+	}
+	ip := net.ParseIP(GetIP(r))
+	if ip == nil {
+		return ""
+	}
+	var record geoipRecord
+	if err := geoipDB.Lookup(ip, &record); err != nil {
+		return ""
+	}
+	return record.Country.ISOCode
+}
+
+/*
+Record a view from a country, per day across the site and in total per
+page. Daily counts expire once they're past the retention period.
+*/
+func TrackCountry(p *Page, country string) error {
+	rc, err := GetRedisClient()
+	defer PutRedisClient(rc)
+	if err != nil {
+		return err
+	}
+	bucket := timebucket(DaySeconds)
+	key := fmt.Sprintf(CountryViews, bucket)
+	err = rc.Cmd("ZINCRBY", key, 1, country).Err
+	if err != nil {
+		return err
+	}
+	if retentionDays != 0 {
+		err = rc.Cmd("EXPIRE", key, (retentionDays+1)*DaySeconds).Err
+		if err != nil {
+			return err
+		}
+	}
+	return rc.Cmd("ZINCRBY", fmt.Sprintf(PageCountryViews, p.Slug), 1, country).Err
+}
+
+/*
+Top countries for a page, or across the site over the trailing
+number of days if slug is empty.
+*/
+func TopCountries(slug string, days int, count int) ([]Counted, error) {
+	if slug != "" {
+		return TopCounts(fmt.Sprintf(PageCountryViews, slug), count)
+	}
+	totals := make(map[string]int)
+	today := timebucket(DaySeconds)
+	for bucket := today - days + 1; bucket <= today; bucket++ {
+		counts, err := TopCounts(fmt.Sprintf(CountryViews, bucket), -1)
+		if err != nil {
+			return []Counted{}, err
+		}
+		for _, c := range counts {
+			totals[c.Key] += c.Count
+		}
+	}
+	top := make([]Counted, 0, len(totals))
+	for country, total := range totals {
+		top = append(top, Counted{Key: country, Count: total})
+	}
+	sort.Slice(top, func(i, j int) bool { return top[i].Count > top[j].Count })
+	if len(top) > count {
+		top = top[:count]
+	}
+	return top, nil
+}
@@ -0,0 +1,97 @@
+// Syntax highlighting code blocks into Pygments compatible HTML.
+package icarus
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/chroma"
+	"github.com/alecthomas/chroma/lexers"
+)
+
+var highlightLineNumbers = false
+
+/*
+The token classes styled by static/pygments.css. Chroma's lexers are
+ported from Pygments and use the same class names, but have some
+finer grained token types than the stylesheet knows about, which are
+given the class of the nearest type it does.
+*/
+var pygmentsClasses = map[string]bool{
+	"c": true, "err": true, "k": true, "o": true, "cm": true, "cp": true,
+	"c1": true, "cs": true, "gd": true, "ge": true, "gr": true, "gh": true,
+	"gi": true, "go": true, "gp": true, "gs": true, "gu": true, "gt": true,
+	"kc": true, "kd": true, "kp": true, "kr": true, "kt": true, "m": true,
+	"s": true, "na": true, "nb": true, "nc": true, "no": true, "nd": true,
+	"ni": true, "ne": true, "nf": true, "nl": true, "nn": true, "nt": true,
+	"nv": true, "ow": true, "w": true, "mf": true, "mh": true, "mi": true,
+	"mo": true, "sb": true, "sc": true, "sd": true, "s2": true, "se": true,
+	"sh": true, "si": true, "sx": true, "sr": true, "s1": true, "ss": true,
+	"bp": true, "vc": true, "vg": true, "vi": true, "il": true,
+}
+
+// The Pygments class for a token type.
+func pygmentsClass(t chroma.TokenType) string {
+	for _, tt := range []chroma.TokenType{t, t.SubCategory(), t.Category()} {
+		if class := chroma.StandardTypes[tt]; pygmentsClasses[class] {
+			return class
+		}
+	}
+	// unstyled, like Pygments' n and p, or plain text
+	return chroma.StandardTypes[t]
+}
+
+func writeToken(b *bytes.Buffer, class string, text string) {
+	if class == "" {
+		b.WriteString(html.EscapeString(text))
+		return
+	}
+	fmt.Fprintf(b, `<span class="%v">%v</span>`, class, html.EscapeString(text))
+}
+
+// Render code in a language as a series of Pygments classed spans.
+func highlightTokens(lang string, code string) (string, bool) {
+	lexer := lexers.Get(lang)
+	if lexer == nil {
+		return "", false
+	}
+	tokens, err := chroma.Coalesce(lexer).Tokenise(nil, code)
+	if err != nil {
+		log.Printf("error highlighting %v code: %v", lang, err)
+		return "", false
+	}
+	var b bytes.Buffer
+	for _, t := range tokens.Tokens() {
+		writeToken(&b, pygmentsClass(t.Type), t.Value)
+	}
+	return b.String(), true
+}
+
+/*
+Highlight code in the given language, wrapped the way Pygments'
+HtmlFormatter does with cssclass=highlight, optionally with a table
+of line numbers. Unknown languages are escaped but not highlighted.
+*/
+func Highlight(lang string, code string) string {
+	code = strings.TrimRight(code, "\n") + "\n"
+	body, ok := highlightTokens(strings.ToLower(lang), code)
+	if !ok {
+		body = html.EscapeString(code)
+	}
+	block := `<div class="highlight"><pre>` + body + "</pre></div>\n"
+	if !highlightLineNumbers {
+		return block
+	}
+	lines := strings.Count(code, "\n")
+	nums := make([]string, lines)
+	for i := range nums {
+		nums[i] = strconv.Itoa(i + 1)
+	}
+	return `<table class="highlighttable"><tr><td class="linenos"><div class="linenodiv"><pre>` +
+		strings.Join(nums, "\n") + `</pre></div></td><td class="code">` +
+		strings.TrimRight(block, "\n") + "</td></tr></table>\n"
+}
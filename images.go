@@ -0,0 +1,259 @@
+// Resizing images referenced by pages into responsive variants.
+package icarus
+
+import (
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/nfnt/resize"
+)
+
+var imageStaticDir = "static/"
+var imageDomain = ""
+var imageWidths = []int{480, 960, 1440}
+var thumbnailWidth = 320
+var imageQuality = 85
+
+var srcAttr = regexp.MustCompile(`(?i)\ssrc\s*=\s*["']([^"']+)["']`)
+
+// The attributes setAttr adds, so it only adds those not already set.
+var imageAttrs = map[string]*regexp.Regexp{
+	"width":   regexp.MustCompile(`(?i)\swidth\s*=`),
+	"height":  regexp.MustCompile(`(?i)\sheight\s*=`),
+	"loading": regexp.MustCompile(`(?i)\sloading\s*=`),
+	"srcset":  regexp.MustCompile(`(?i)\ssrcset\s*=`),
+	"sizes":   regexp.MustCompile(`(?i)\ssizes\s*=`),
+}
+
+func ConfigImages(cfg *Config) error {
+	if cfg.Blog.StaticDir != "" {
+		imageStaticDir = cfg.Blog.StaticDir
+	}
+	imageDomain = cfg.Server.Domain
+	if len(cfg.Images.Widths) > 0 {
+		for _, w := range cfg.Images.Widths {
+			if w <= 0 {
+				return fmt.Errorf("image widths must be positive, not %v", w)
+			}
+		}
+		// sorted as a copy, so the config is left as it was
+		imageWidths = append([]int{}, cfg.Images.Widths...)
+		sort.Ints(imageWidths)
+	}
+	if cfg.Images.ThumbnailWidth < 0 {
+		return fmt.Errorf("thumbnail_width must be positive, not %v", cfg.Images.ThumbnailWidth)
+	} else if cfg.Images.ThumbnailWidth > 0 {
+		thumbnailWidth = cfg.Images.ThumbnailWidth
+	}
+	if cfg.Images.Quality < 0 || cfg.Images.Quality > 100 {
+		return fmt.Errorf("image quality must be between 1 and 100, not %v", cfg.Images.Quality)
+	} else if cfg.Images.Quality > 0 {
+		imageQuality = cfg.Images.Quality
+	}
+	return nil
+}
+
+/*
+Map an image's URL onto its file in the static dir, if it's served from
+there, either as a path or as a URL on the site's domain. Query strings
+and fragments are ignored, and escaped characters unescaped.
+*/
+func localImagePath(src string) (string, bool) {
+	u, err := url.Parse(src)
+	if err != nil {
+		return "", false
+	}
+	if u.Host != "" && ((u.Scheme != "" && u.Scheme != "http" && u.Scheme != "https") || !isSiteHost(u.Hostname(), imageDomain)) {
+		return "", false
+	}
+	if !strings.HasPrefix(u.Path, "/static/") || strings.Contains(u.Path, "..") {
+		return "", false
+	}
+	return filepath.Join(imageStaticDir, filepath.FromSlash(strings.TrimPrefix(u.Path, "/static/"))), true
+}
+
+// The path of an image's variant, foo.jpg becomes foo-480w.jpg.
+func variantName(name string, width int) string {
+	ext := path.Ext(name)
+	return fmt.Sprintf("%v-%vw%v", strings.TrimSuffix(name, ext), width, ext)
+}
+
+// The URL of an image's variant, without the image's query string or fragment.
+func variantURL(src string, width int) string {
+	u, err := url.Parse(src)
+	if err != nil {
+		return variantName(src, width)
+	}
+	u.Path = variantName(u.Path, width)
+	u.RawPath, u.RawQuery, u.Fragment = "", "", ""
+	return u.String()
+}
+
+// Check a variant of the image exists and is newer than it.
+func variantFresh(file string, width int) bool {
+	orig, err := os.Stat(file)
+	if err != nil {
+		return false
+	}
+	existing, err := os.Stat(variantName(file, width))
+	return err == nil && existing.ModTime().After(orig.ModTime())
+}
+
+/*
+Write a variant of the image. Failed variants are removed, so they're
+written again next time.
+*/
+func writeVariant(file string, img image.Image, format string, width int) (err error) {
+	variant := variantName(file, width)
+	resized := resize.Resize(uint(width), 0, img, resize.Lanczos3)
+	f, err := os.Create(variant)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(variant)
+		}
+	}()
+	if format == "jpeg" {
+		return jpeg.Encode(f, resized, &jpeg.Options{Quality: imageQuality})
+	}
+	return png.Encode(f, resized)
+}
+
+/*
+Generate variants of a local image for each configured width narrower
+than it, returning its dimensions and the widths generated. The image
+is only decoded if one of its variants is missing or older than it.
+*/
+func processImage(file string) (int, int, []int, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	defer f.Close()
+	cfg, format, err := image.DecodeConfig(f)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	widths := []int{}
+	candidates := append([]int{thumbnailWidth}, imageWidths...)
+	sort.Ints(candidates)
+	for _, w := range candidates {
+		if w < cfg.Width && (len(widths) == 0 || widths[len(widths)-1] != w) {
+			widths = append(widths, w)
+		}
+	}
+	// animated gifs would lose their animation, so are left at full size
+	if len(widths) == 0 || (format != "jpeg" && format != "png") {
+		return cfg.Width, cfg.Height, []int{}, nil
+	}
+	stale := []int{}
+	for _, w := range widths {
+		if !variantFresh(file, w) {
+			stale = append(stale, w)
+		}
+	}
+	if len(stale) == 0 {
+		return cfg.Width, cfg.Height, widths, nil
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return 0, 0, nil, err
+	}
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	for _, w := range stale {
+		err := writeVariant(file, img, format, w)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+	}
+	return cfg.Width, cfg.Height, widths, nil
+}
+
+// Add an attribute to a tag, unless it's already set.
+func setAttr(tag string, name string, value string) string {
+	if imageAttrs[name].MatchString(tag) {
+		return tag
+	}
+	end := strings.LastIndex(tag, ">")
+	if strings.HasSuffix(tag[:end], "/") {
+		end -= 1
+	}
+	return strings.TrimRight(tag[:end], " ") + fmt.Sprintf(` %v="%v"`, name, value) + tag[end:]
+}
+
+/*
+Generate resized variants of the local images in a page's content,
+rewriting their tags with srcset, dimensions and lazy loading, and
+record the first image as the page's lead image. Images which can't be
+processed are logged and left as they are.
+*/
+func ProcessImages(p *Page) error {
+	p.LeadImage, p.Thumbnail = "", ""
+	failed := 0
+	p.Content = imgTag.ReplaceAllStringFunc(p.Content, func(tag string) string {
+		m := srcAttr.FindStringSubmatch(tag)
+		if m == nil {
+			return tag
+		}
+		src := m[1]
+		if p.LeadImage == "" {
+			p.LeadImage = src
+		}
+		file, ok := localImagePath(src)
+		if !ok {
+			return tag
+		}
+		width, height, widths, err := processImage(file)
+		if err != nil {
+			log.Printf("failed processing image %v in %v: %v", src, p.Slug, err)
+			failed += 1
+			return tag
+		}
+		if src == p.LeadImage && p.Thumbnail == "" {
+			p.Thumbnail = src
+			for _, w := range widths {
+				if w == thumbnailWidth {
+					p.Thumbnail = variantURL(src, w)
+				}
+			}
+		}
+		// setting only one dimension scales the image, so don't add the other
+		if !imageAttrs["width"].MatchString(tag) && !imageAttrs["height"].MatchString(tag) {
+			tag = setAttr(tag, "width", fmt.Sprint(width))
+			tag = setAttr(tag, "height", fmt.Sprint(height))
+		}
+		tag = setAttr(tag, "loading", "lazy")
+		if len(widths) > 0 {
+			srcset := []string{}
+			for _, w := range widths {
+				srcset = append(srcset, fmt.Sprintf("%v %vw", variantURL(src, w), w))
+			}
+			srcset = append(srcset, fmt.Sprintf("%v %vw", src, width))
+			tag = setAttr(tag, "srcset", strings.Join(srcset, ", "))
+			tag = setAttr(tag, "sizes", fmt.Sprintf("(max-width: %vpx) 100vw, %vpx", width, width))
+		}
+		return tag
+	})
+	if failed > 0 {
+		return fmt.Errorf("failed processing %v images", failed)
+	}
+	return nil
+}
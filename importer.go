@@ -0,0 +1,320 @@
+// Importing historical analytics from Google Analytics CSV exports.
+package icarus
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mediocregopher/radix.v2/redis"
+)
+
+const HistoricalReferrers = "analytics.refer_historical"
+const PageHistoricalReferrers = "analytics.refer_historical.%v"
+const AnalyticsImports = "analytics.imports"
+
+// Views imported for each day and page, keyed by "<bucket>.<slug>".
+const AnalyticsImportedDays = "analytics.imported_days"
+
+// Header names used by Google Analytics exports for each column we need.
+var gaColumns = map[string][]string{
+	"page":   {"page", "page path", "landing page", "pagepath"},
+	"date":   {"date", "day"},
+	"views":  {"pageviews", "page views", "views"},
+	"source": {"source", "source / medium", "referrer"},
+}
+
+type ImportSummary struct {
+	Rows       int
+	Imported   int
+	Skipped    int
+	Duplicates int
+	Views      int
+}
+
+func (s *ImportSummary) String() string {
+	return fmt.Sprintf("%v rows, %v imported (%v views), %v skipped, %v already imported", s.Rows, s.Imported, s.Views, s.Skipped, s.Duplicates)
+}
+
+// Map a path (or full URL) from Google Analytics onto a page slug.
+func SlugFromPath(path string) string {
+	if u, err := url.Parse(path); err == nil {
+		path = u.Path
+	}
+	return strings.Trim(path, "/")
+}
+
+// Map a Google Analytics source onto the referrer we track it as.
+func historicalSource(source string) string {
+	source = strings.TrimSpace(source)
+	if i := strings.Index(source, " / "); i != -1 {
+		source = source[:i]
+	}
+	switch source {
+	case "", "(direct)", "(none)", "(not set)":
+		return HistoricalReferrer
+	}
+	return source
+}
+
+func parseGADate(s string) (int, error) {
+	for _, layout := range []string{"20060102", "2006-01-02", "01/02/2006", "1/2/06"} {
+		t, err := time.Parse(layout, s)
+		if err == nil {
+			return int(t.Unix() / DaySeconds), nil
+		}
+	}
+	return 0, fmt.Errorf("unrecognized date %v", s)
+}
+
+// Find the index of each column we need from the header row.
+func gaColumnIndexes(header []string) (map[string]int, error) {
+	idx := make(map[string]int)
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		for col, names := range gaColumns {
+			for _, n := range names {
+				if n == name {
+					idx[col] = i
+				}
+			}
+		}
+	}
+	for _, col := range []string{"page", "date", "views"} {
+		if _, ok := idx[col]; !ok {
+			return idx, fmt.Errorf("export has no %v column in header %v", col, header)
+		}
+	}
+	return idx, nil
+}
+
+/*
+Import a Google Analytics CSV export into analytics.pv, the daily
+page view buckets and the referrer sets.
+
+Exports have a header row with Page, Date, Pageviews and optionally
+Source columns, and are prefixed by # comments which are ignored.
+Referrers are recorded in HistoricalReferrers as well as the usual
+referrer sets, with direct traffic recorded as HistoricalReferrer.
+Rows for slugs which don't exist are skipped, and views for each day
+and page are only imported once, so exports may overlap and an import
+which fails partway can be run again.
+*/
+func ImportGoogleAnalytics(r io.Reader) (*ImportSummary, error) {
+	summary := &ImportSummary{}
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return summary, err
+	}
+	// strip the comment preamble and blank lines GA includes
+	lines := []string{}
+	for _, line := range strings.Split(string(raw), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	reader := csv.NewReader(strings.NewReader(strings.Join(lines, "\n")))
+	reader.FieldsPerRecord = -1
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return summary, err
+	}
+	if len(rows) == 0 {
+		return summary, fmt.Errorf("export is empty")
+	}
+	idx, err := gaColumnIndexes(rows[0])
+	if err != nil {
+		return summary, err
+	}
+
+	rc, err := GetRedisClient()
+	defer PutRedisClient(rc)
+	if err != nil {
+		return summary, err
+	}
+	h := sha256.Sum256(raw)
+	digest := hex.EncodeToString(h[:])
+	imported, err := rc.Cmd("SISMEMBER", AnalyticsImports, digest).Int()
+	if err != nil {
+		return summary, err
+	}
+	if imported == 1 {
+		return summary, fmt.Errorf("export %v has already been imported", digest[:12])
+	}
+
+	// group rows by day and page, since each is imported at most once
+	days := []*importDay{}
+	grouped := make(map[string]*importDay)
+	exists := make(map[string]bool)
+	for _, row := range rows[1:] {
+		summary.Rows += 1
+		field := func(col string) string {
+			i, ok := idx[col]
+			if !ok || i >= len(row) {
+				return ""
+			}
+			return strings.TrimSpace(row[i])
+		}
+		slug := SlugFromPath(field("page"))
+		views, err := strconv.Atoi(strings.Replace(field("views"), ",", "", -1))
+		if err != nil || slug == "" || views <= 0 {
+			summary.Skipped += 1
+			continue
+		}
+		bucket, err := parseGADate(field("date"))
+		if err != nil {
+			log.Printf("skipping row %v: %v", row, err)
+			summary.Skipped += 1
+			continue
+		}
+		if _, ok := exists[slug]; !ok {
+			n, err := rc.Cmd("EXISTS", fmt.Sprintf(PageString, slug)).Int()
+			if err != nil {
+				return summary, err
+			}
+			exists[slug] = n == 1
+		}
+		if !exists[slug] {
+			summary.Skipped += 1
+			continue
+		}
+		key := fmt.Sprintf("%v.%v", bucket, slug)
+		day, ok := grouped[key]
+		if !ok {
+			day = &importDay{Bucket: bucket, Slug: slug, Referrers: make(map[string]int)}
+			grouped[key] = day
+			days = append(days, day)
+		}
+		day.Rows += 1
+		day.Views += views
+		day.Referrers[historicalSource(field("source"))] += views
+	}
+
+	for _, day := range days {
+		ok, err := importDayViews(rc, day)
+		if err != nil {
+			return summary, err
+		}
+		if !ok {
+			summary.Duplicates += day.Rows
+			continue
+		}
+		summary.Imported += day.Rows
+		summary.Views += day.Views
+	}
+	err = rc.Cmd("SADD", AnalyticsImports, digest).Err
+	return summary, err
+}
+
+// Page views for one page on one day, gathered from an export's rows.
+type importDay struct {
+	Bucket    int
+	Slug      string
+	Rows      int
+	Views     int
+	Referrers map[string]int
+}
+
+/*
+Record the views for a day and page, along with the day's rollups if
+it has already been rolled up, returning false if views for that day
+and page were already imported.
+
+The views are claimed in AnalyticsImportedDays and recorded in one
+transaction, so an import which fails partway can be run again, and
+exports with overlapping dates don't count a day twice.
+*/
+func importDayViews(rc *redis.Client, day *importDay) (bool, error) {
+	field := fmt.Sprintf("%v.%v", day.Bucket, day.Slug)
+	err := rc.Cmd("WATCH", AnalyticsImportedDays, RollupWatermark, rollupWatermarkKey(""), rollupWatermarkKey(day.Slug)).Err
+	if err != nil {
+		return false, err
+	}
+	defer rc.Cmd("UNWATCH")
+	claimed, err := rc.Cmd("HEXISTS", AnalyticsImportedDays, field).Int()
+	if err != nil || claimed == 1 {
+		return false, err
+	}
+	siteWatermark, err := rollupWatermark(rc, "")
+	if err != nil {
+		return false, err
+	}
+	pageWatermark, err := rollupWatermark(rc, day.Slug)
+	if err != nil {
+		return false, err
+	}
+
+	err = rc.Cmd("MULTI").Err
+	if err != nil {
+		return false, err
+	}
+	err = queueImportDay(rc, day, field, siteWatermark, pageWatermark)
+	if err != nil {
+		rc.Cmd("DISCARD")
+		return false, err
+	}
+	resp := rc.Cmd("EXEC")
+	if resp.Err != nil {
+		return false, resp.Err
+	}
+	if resp.IsType(redis.Nil) {
+		return false, fmt.Errorf("views for %v on %v changed during the import, run it again", day.Slug, BucketDate(day.Bucket).Format("2006-01-02"))
+	}
+	return true, nil
+}
+
+// Queue the commands recording a day's views inside a transaction.
+func queueImportDay(rc *redis.Client, day *importDay, field string, siteWatermark int, pageWatermark int) error {
+	err := rc.Cmd("HSET", AnalyticsImportedDays, field, day.Views).Err
+	if err != nil {
+		return err
+	}
+	err = rc.Cmd("ZINCRBY", PageViews, day.Views, day.Slug).Err
+	if err != nil {
+		return err
+	}
+	for _, key := range []string{PageViewBucket, fmt.Sprintf(PageViewPageBucket, day.Slug)} {
+		err := rc.Cmd("ZINCRBY", key, day.Views, day.Bucket).Err
+		if err != nil {
+			return err
+		}
+	}
+	// days which were already rolled up won't be again
+	if day.Bucket <= siteWatermark {
+		err := addToRollups(rc, "", day.Bucket, day.Views)
+		if err != nil {
+			return err
+		}
+	}
+	if day.Bucket <= pageWatermark {
+		err := addToRollups(rc, day.Slug, day.Bucket, day.Views)
+		if err != nil {
+			return err
+		}
+	}
+	for referrer, views := range day.Referrers {
+		referKeys := []string{
+			Referrers,
+			fmt.Sprintf(PageReferrers, day.Slug),
+			HistoricalReferrers,
+			fmt.Sprintf(PageHistoricalReferrers, day.Slug),
+		}
+		for _, key := range referKeys {
+			err := rc.Cmd("ZINCRBY", key, views, referrer).Err
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,468 @@
+// Checking pages for mistakes before they're loaded.
+package icarus
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// A problem found in a page, Line and Column start at 1.
+type Diagnostic struct {
+	File    string
+	Line    int
+	Column  int
+	Message string
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%v:%v:%v: %v", d.File, d.Line, d.Column, d.Message)
+}
+
+// The type each header must have.
+var headerTypes = map[string]string{
+	"title":     "string",
+	"summary":   "string",
+	"slug":      "string",
+	"tags":      "list of strings",
+	"draft":     "bool",
+	"pub_date":  "timestamp",
+	"edit_date": "timestamp",
+}
+
+var headerNames = []string{"draft", "edit_date", "pub_date", "slug", "summary", "tags", "title"}
+
+// Paths served by Icarus itself rather than pages.
+var reservedPaths = map[string]bool{
+	"static": true, "list": true, "tags": true, "feeds": true, "search": true,
+	"out": true, "beacon": true, "consent": true, "live": true,
+}
+
+var validSlug = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+var errorLine = regexp.MustCompile(`line (\d+)`)
+var markdownLink = regexp.MustCompile(`!?\[([^\]]*)\]\(\s*<?([^)\s>]+)`)
+var hrefAttr = regexp.MustCompile(`(?i)\bhref\s*=\s*["']([^"']+)["']`)
+var imgTag = regexp.MustCompile(`(?i)<img\b[^>]*>`)
+var altAttr = regexp.MustCompile(`(?i)\salt\s*=`)
+var fencedCode = regexp.MustCompile("(?ms)^[ \t]*```.*?^[ \t]*```[^\n]*$")
+var inlineCode = regexp.MustCompile("`[^`\n]+`")
+
+/*
+Checks pages, tracking the slugs seen so far to find duplicates
+and to resolve internal links without a trip to Redis.
+*/
+type Linter struct {
+	Domain      string
+	Diagnostics []Diagnostic
+	slugs       map[string]string
+	links       []lintLink
+}
+
+type lintLink struct {
+	Diagnostic
+	Slug string
+}
+
+func NewLinter(cfg *Config) *Linter {
+	return &Linter{Domain: strings.ToLower(cfg.Server.Domain), slugs: make(map[string]string)}
+}
+
+// Line and column, counting runes, of a byte offset into content.
+func position(content string, offset int) (int, int) {
+	if offset > len(content) {
+		offset = len(content)
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	before := content[:offset]
+	line := strings.Count(before, "\n") + 1
+	col := utf8.RuneCountInString(before[strings.LastIndex(before, "\n")+1:]) + 1
+	return line, col
+}
+
+func (l *Linter) addAt(file string, content string, offset int, format string, args ...interface{}) {
+	line, col := position(content, offset)
+	l.add(file, line, col, format, args...)
+}
+
+func (l *Linter) add(file string, line int, col int, format string, args ...interface{}) {
+	l.Diagnostics = append(l.Diagnostics, Diagnostic{file, line, col, fmt.Sprintf(format, args...)})
+}
+
+// Header keys as they're written in each format, with the key as the first group.
+var headerKeys = map[string]*regexp.Regexp{
+	"json": regexp.MustCompile(`"([^"\\]*)"\s*:`),
+	"yaml": regexp.MustCompile(`(?m)^["']?([^"'\s:]+)["']?\s*:`),
+	"toml": regexp.MustCompile(`(?m)^\s*["']?([^"'\s=]+)["']?\s*=`),
+}
+
+// Find where a header is set, returning the offset into head or -1.
+func headerKeyOffset(format string, head string, key string) int {
+	for _, loc := range headerKeys[format].FindAllStringSubmatchIndex(head, -1) {
+		if head[loc[2]:loc[3]] != key {
+			continue
+		}
+		rest := head[loc[0]:]
+		return loc[0] + len(rest) - len(strings.TrimLeft(rest, " \t"))
+	}
+	return -1
+}
+
+// Levenshtein distance, for suggesting a header when one is misspelled.
+func editDistance(a string, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := []int{i}
+		for j := 1; j <= len(b); j++ {
+			cost := prev[j-1]
+			if a[i-1] != b[j-1] {
+				cost += 1
+			}
+			cost = minInt(cost, minInt(prev[j]+1, cur[j-1]+1))
+			cur = append(cur, cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Check a header's value has the right type for its key.
+func headerTypeOK(format string, kind string, v interface{}) bool {
+	switch kind {
+	case "string":
+		_, ok := v.(string)
+		return ok
+	case "bool":
+		_, ok := v.(bool)
+		return ok
+	case "list of strings":
+		items, ok := v.([]interface{})
+		if !ok {
+			return false
+		}
+		for _, item := range items {
+			if _, ok := item.(string); !ok {
+				return false
+			}
+		}
+		return true
+	case "timestamp":
+		// timestamps are whole seconds, and pages store them as integers
+		if f, ok := v.(float64); ok {
+			return f == math.Trunc(f)
+		}
+		if format == "json" {
+			return false
+		}
+		_, err := frontMatterDate(v)
+		return err == nil && v != nil
+	}
+	return false
+}
+
+/*
+Parse a page's header into a map, reporting syntax errors, and return
+the header's format, text, offset into content and the page body.
+*/
+func (l *Linter) parseHeader(file string, content string) (string, string, int, string, map[string]interface{}, bool) {
+	headers := make(map[string]interface{})
+	if hasFrontMatter(content) {
+		format := "yaml"
+		if content[0] == '+' {
+			format = "toml"
+		}
+		headOffset := strings.Index(content, "\n") + 1
+		_, head, rest, err := splitFrontMatter(content)
+		if err != nil {
+			l.add(file, 1, 1, "%v", err)
+			return format, head, headOffset, rest, headers, false
+		}
+		if format == "yaml" {
+			err = yaml.Unmarshal([]byte(head), &headers)
+		} else {
+			_, err = toml.Decode(head, &headers)
+		}
+		if err != nil {
+			line := 1
+			if m := errorLine.FindStringSubmatch(err.Error()); m != nil {
+				line, _ = strconv.Atoi(m[1])
+			}
+			l.add(file, line+1, 1, "invalid %v front matter: %v", strings.ToUpper(format), err)
+			return format, head, headOffset, rest, headers, false
+		}
+		return format, head, headOffset, rest, headers, true
+	}
+
+	head, rest, err := splitHeader(content)
+	if err != nil {
+		l.add(file, 1, 1, "couldn't find the end of the header, it must be followed by a blank line outside of any string or list")
+		return "json", head, 0, rest, headers, false
+	}
+	trimmed := strings.TrimSuffix(strings.TrimSuffix(head, "\n"), ",")
+	err = json.Unmarshal([]byte("{\n"+trimmed+"}\n"), &headers)
+	if err != nil {
+		// the offset is just past the bad byte, and counts the {\n we wrapped the header in
+		offset := 0
+		if e, ok := err.(*json.SyntaxError); ok {
+			offset = int(e.Offset) - 3
+		}
+		if offset >= len(trimmed) {
+			offset = len(trimmed) - 1
+		}
+		l.addAt(file, content, offset, "invalid header: %v", err)
+		return "json", head, 0, rest, headers, false
+	}
+	return "json", head, 0, rest, headers, true
+}
+
+// Check a page's header, returning its slug if it has a valid one.
+func (l *Linter) lintHeader(file string, content string) (string, string, int) {
+	format, head, headOffset, rest, headers, ok := l.parseHeader(file, content)
+	bodyOffset := len(content) - len(rest)
+	if !ok {
+		return "", rest, bodyOffset
+	}
+	at := func(key string) int {
+		offset := headerKeyOffset(format, head, key)
+		if offset == -1 {
+			return 0
+		}
+		return headOffset + offset
+	}
+
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		kind, known := headerTypes[key]
+		if !known {
+			suggestion, best := "", 3
+			for _, candidate := range headerNames {
+				if d := editDistance(key, candidate); d < best {
+					suggestion, best = fmt.Sprintf(", did you mean %q?", candidate), d
+				}
+			}
+			l.addAt(file, content, at(key), "unknown header %q%v", key, suggestion)
+			continue
+		}
+		if !headerTypeOK(format, kind, headers[key]) {
+			l.addAt(file, content, at(key), "header %q should be a %v, not %v", key, kind, headers[key])
+		}
+	}
+
+	if title, _ := headers["title"].(string); strings.TrimSpace(title) == "" {
+		l.add(file, 1, 1, "missing title")
+	}
+	slug, _ := headers["slug"].(string)
+	if slug == "" {
+		l.add(file, 1, 1, "missing slug")
+		return "", rest, bodyOffset
+	}
+	if !validSlug.MatchString(slug) {
+		l.addAt(file, content, at("slug"), "slug %q should only contain lowercase letters, digits, '.', '-' and '_'", slug)
+	}
+	if prev, ok := l.slugs[slug]; ok {
+		l.addAt(file, content, at("slug"), "duplicate slug %q, also used by %v", slug, prev)
+	} else {
+		l.slugs[slug] = file
+	}
+	return slug, rest, bodyOffset
+}
+
+/*
+Blank out code in Markdown, keeping offsets the same, so links and
+images in examples aren't checked.
+*/
+func maskCode(body string) string {
+	blank := func(s string) string {
+		return strings.Map(func(r rune) rune {
+			if r == '\n' {
+				return r
+			}
+			return ' '
+		}, s)
+	}
+	body = fencedCode.ReplaceAllStringFunc(body, blank)
+	lines := strings.SplitAfter(body, "\n")
+	inCode := false
+	for i, line := range lines {
+		indented := strings.HasPrefix(line, "    ") || strings.HasPrefix(line, "\t")
+		blankLine := strings.TrimSpace(line) == ""
+		if indented && (inCode || i == 0 || strings.TrimSpace(lines[i-1]) == "") {
+			inCode = true
+		} else if !blankLine {
+			inCode = false
+		}
+		if inCode {
+			lines[i] = blank(line)
+		}
+	}
+	body = strings.Join(lines, "")
+	return inlineCode.ReplaceAllStringFunc(body, blank)
+}
+
+// Map a link onto the slug of the page it points at, if it's internal to domain.
+func internalSlug(domain string, link string) (string, bool) {
+	u, err := url.Parse(link)
+	if err != nil || (u.Scheme != "" && u.Scheme != "http" && u.Scheme != "https") {
+		return "", false
+	}
+	if u.Host != "" && strings.ToLower(u.Host) != domain {
+		return "", false
+	}
+	if !strings.HasPrefix(u.Path, "/") {
+		return "", false
+	}
+	slug := strings.Trim(u.Path, "/")
+	if slug == "" || reservedPaths[strings.Split(slug, "/")[0]] {
+		return "", false
+	}
+	return slug, true
+}
+
+// Check a page's body for internal links and images without alt text.
+func (l *Linter) lintBody(file string, content string, body string, bodyOffset int) {
+	if filepath.Ext(file) == ".md" {
+		body = maskCode(body)
+		for _, m := range shortcodeTag.FindAllStringSubmatchIndex(body, -1) {
+			if name := body[m[4]:m[5]]; Shortcodes[name] == nil {
+				l.addAt(file, content, bodyOffset+m[0], "unknown shortcode %q", name)
+			}
+		}
+		for _, m := range markdownLink.FindAllStringSubmatchIndex(body, -1) {
+			text, link := body[m[2]:m[3]], body[m[4]:m[5]]
+			if body[m[0]] == '!' {
+				if strings.TrimSpace(text) == "" {
+					l.addAt(file, content, bodyOffset+m[0], "image %v is missing alt text", link)
+				}
+				continue
+			}
+			l.checkLink(file, content, bodyOffset+m[4], link)
+		}
+		for _, m := range wikiLink.FindAllStringSubmatchIndex(body, -1) {
+			slug := wikiSlug(body[m[2]:m[3]])
+			l.checkLink(file, content, bodyOffset+m[2], (&url.URL{Path: "/" + slug + "/"}).EscapedPath())
+		}
+	}
+	for _, m := range hrefAttr.FindAllStringSubmatchIndex(body, -1) {
+		l.checkLink(file, content, bodyOffset+m[2], body[m[2]:m[3]])
+	}
+	for _, m := range imgTag.FindAllStringIndex(body, -1) {
+		if !altAttr.MatchString(body[m[0]:m[1]]) {
+			l.addAt(file, content, bodyOffset+m[0], "image is missing an alt attribute")
+		}
+	}
+}
+
+// Hold internal links until every file's slugs are known.
+func (l *Linter) checkLink(file string, content string, offset int, link string) {
+	slug, ok := internalSlug(l.Domain, link)
+	if !ok {
+		return
+	}
+	line, col := position(content, offset)
+	l.links = append(l.links, lintLink{Diagnostic{file, line, col, ""}, slug})
+}
+
+// Check a page, given its filename and content.
+func (l *Linter) Lint(file string, content string) {
+	content = strings.TrimPrefix(content, "\ufeff")
+	_, body, bodyOffset := l.lintHeader(file, content)
+	l.lintBody(file, content, body, bodyOffset)
+}
+
+/*
+Report internal links which don't point at any of the pages linted
+or any page in Redis, and return all the diagnostics, ordered by file
+and position. If Redis can't be reached links are only checked against
+the pages linted.
+*/
+func (l *Linter) Finish() []Diagnostic {
+	exists := make(map[string]bool)
+	for slug := range l.slugs {
+		exists[slug] = true
+	}
+	for _, link := range l.links {
+		found, checked := exists[link.Slug]
+		if !checked && redisPool != nil {
+			var err error
+			found, err = pageExists(link.Slug)
+			if err != nil {
+				log.Printf("failed checking %v in redis: %v", link.Slug, err)
+				found = true
+			}
+			exists[link.Slug] = found
+		}
+		if !found {
+			link.Message = fmt.Sprintf("broken internal link to %q, no page has that slug", link.Slug)
+			l.Diagnostics = append(l.Diagnostics, link.Diagnostic)
+		}
+	}
+	l.links = nil
+	sort.Stable(byPosition(l.Diagnostics))
+	return l.Diagnostics
+}
+
+// Check if a page with the slug has been loaded into Redis.
+func pageExists(slug string) (bool, error) {
+	rc, err := GetRedisClient()
+	defer PutRedisClient(rc)
+	if err != nil {
+		return false, err
+	}
+	n, err := rc.Cmd("EXISTS", fmt.Sprintf(PageString, slug)).Int()
+	return n == 1, err
+}
+
+type byPosition []Diagnostic
+
+func (d byPosition) Len() int      { return len(d) }
+func (d byPosition) Swap(i, j int) { d[i], d[j] = d[j], d[i] }
+func (d byPosition) Less(i, j int) bool {
+	if d[i].File != d[j].File {
+		return d[i].File < d[j].File
+	}
+	if d[i].Line != d[j].Line {
+		return d[i].Line < d[j].Line
+	}
+	return d[i].Column < d[j].Column
+}
+
+// Lint each file, returning the diagnostics found.
+func LintFiles(cfg *Config, files []string) []Diagnostic {
+	l := NewLinter(cfg)
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			l.add(file, 1, 1, "couldn't read file: %v", err)
+			continue
+		}
+		l.Lint(file, string(content))
+	}
+	return l.Finish()
+}
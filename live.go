@@ -0,0 +1,190 @@
+// Streaming page views to connected clients as they happen.
+package icarus
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mediocregopher/radix.v2/pubsub"
+	"github.com/mediocregopher/radix.v2/redis"
+)
+
+const LiveChannel = "analytics.live"
+const LivePath = "/live/"
+const LiveHeartbeat = 15 * time.Second
+const LiveReconnect = 5 * time.Second
+const MaxLiveClients = 100
+
+// Views buffered per client before it's considered behind and misses some.
+const LiveClientBuffer = 64
+
+// One page view, as streamed to live clients.
+type LiveView struct {
+	Slug      string `json:"slug"`
+	Referrer  string `json:"referrer"`
+	Class     string `json:"class"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// Publish a page view to every process's live clients.
+func PublishView(p *Page, referrer string) error {
+	rc, err := GetRedisClient()
+	defer PutRedisClient(rc)
+	if err != nil {
+		return err
+	}
+	msg, err := json.Marshal(&LiveView{
+		Slug:      p.Slug,
+		Referrer:  referrer,
+		Class:     ReferrerClass(referrer),
+		Timestamp: CurrentTimestamp(),
+	})
+	if err != nil {
+		return err
+	}
+	return rc.Cmd("PUBLISH", LiveChannel, msg).Err
+}
+
+// Check the request carries the live token as a bearer token.
+func liveAuthorized(cfg *Config, r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(cfg.Analytics.LiveToken)) == 1
+}
+
+/*
+Fans views from one subscription to LiveChannel out to every live
+client in this process, so clients don't each hold a Redis connection.
+*/
+type liveHub struct {
+	sync.Mutex
+	clients map[chan string]bool
+	started bool
+}
+
+var hub = &liveHub{clients: make(map[chan string]bool)}
+
+// Add a client, starting the subscription for the first one.
+func (h *liveHub) join() (chan string, error) {
+	h.Lock()
+	defer h.Unlock()
+	if len(h.clients) >= MaxLiveClients {
+		return nil, fmt.Errorf("already streaming to %v live clients", MaxLiveClients)
+	}
+	msgs := make(chan string, LiveClientBuffer)
+	h.clients[msgs] = true
+	if !h.started {
+		h.started = true
+		go h.run()
+	}
+	return msgs, nil
+}
+
+func (h *liveHub) leave(msgs chan string) {
+	h.Lock()
+	defer h.Unlock()
+	delete(h.clients, msgs)
+}
+
+// Send a view to every client, dropping it for clients which are behind.
+func (h *liveHub) broadcast(msg string) {
+	h.Lock()
+	defer h.Unlock()
+	for msgs := range h.clients {
+		select {
+		case msgs <- msg:
+		default:
+		}
+	}
+}
+
+// Stay subscribed to LiveChannel, reconnecting if the connection drops.
+func (h *liveHub) run() {
+	for {
+		err := h.subscribe()
+		log.Printf("live subscription closed, reconnecting: %v", err)
+		time.Sleep(LiveReconnect)
+	}
+}
+
+func (h *liveHub) subscribe() error {
+	client, err := redis.Dial(redisProto, redisLocation)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	sub := pubsub.NewSubClient(client)
+	if resp := sub.Subscribe(LiveChannel); resp.Err != nil {
+		return resp.Err
+	}
+	for {
+		resp := sub.Receive()
+		if resp.Err != nil {
+			return resp.Err
+		}
+		if resp.Type == pubsub.Message {
+			h.broadcast(resp.Message)
+		}
+	}
+}
+
+/*
+Build http.HandlerFunc streaming page views as Server-Sent Events.
+
+Clients share one subscription to LiveChannel per process, and at
+most MaxLiveClients are streamed to at once. The endpoint is disabled
+unless analytics.live_token is configured.
+*/
+func makeLiveHandler(cfg *Config) http.HandlerFunc {
+	handle := func(w http.ResponseWriter, r *http.Request) {
+		if cfg.Analytics.LiveToken == "" {
+			notFoundPage(w, r, cfg, fmt.Errorf("live analytics are disabled"))
+			return
+		}
+		if !liveAuthorized(cfg, r) {
+			http.Error(w, "missing or invalid token", http.StatusUnauthorized)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+			return
+		}
+		msgs, err := hub.join()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		defer hub.leave(msgs)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		heartbeat := time.NewTicker(LiveHeartbeat)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case msg := <-msgs:
+				fmt.Fprintf(w, "event: view\ndata: %v\n\n", msg)
+			case <-heartbeat.C:
+				fmt.Fprint(w, ": heartbeat\n\n")
+			case <-r.Context().Done():
+				return
+			}
+			flusher.Flush()
+		}
+	}
+	return handle
+}
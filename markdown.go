@@ -2,10 +2,297 @@
 Utilities for preprocessing Markdown from the Python
 style to the new, different style...
 
-Specifically:
+Preprocessors rewrite the Markdown before blackfriday renders it,
+for example swapping [TOC] for a placeholder, and postprocessors
+rewrite the rendered HTML, for example highlighting code blocks,
+giving headings ids and replacing that placeholder with the table
+of contents. Shortcodes are expanded the same way, swapped for
+placeholders before rendering and for their HTML afterwards.
+*/
+package icarus
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/russross/blackfriday"
+)
+
+var headingAnchors = false
 
-1. strip out [TOC] since there is no support here,
-2. call out to pygments to render code blocks starting with :::<lang>
+func ConfigMarkdown(cfg *Config) error {
+	highlightLineNumbers = cfg.Markdown.LineNumbers
+	headingAnchors = cfg.Markdown.HeadingAnchors
+	return nil
+}
 
+/*
+State kept while a page's Markdown is rendered, which is passed through
+the pre and postprocessors and thrown away afterwards. BodyLine is the
+line of the page's file the Markdown being rendered starts after, and
+WikiPages are the pages wiki links can point at besides those in Redis.
 */
-package icarus
+type RenderContext struct {
+	Page      *Page
+	BodyLine  int
+	WikiPages WikiPages
+
+	// HTML for each shortcode, and wiki links to pages which don't
+	// exist or which couldn't be checked
+	shortcodes      []string
+	brokenLinks     []string
+	unverifiedLinks []string
+}
+
+// Rewrites Markdown before it is rendered.
+type Preprocessor func(ctx *RenderContext, content string) (string, error)
+
+// Rewrites HTML after it is rendered.
+type Postprocessor func(ctx *RenderContext, content string) (string, error)
+
+var Preprocessors []Preprocessor
+var Postprocessors []Postprocessor
+
+/*
+Set in init since shortcodes render their contents with these. Shortcodes
+are placed first, so their contents are highlighted and their headings
+are part of the page's table of contents.
+*/
+func init() {
+	Preprocessors = []Preprocessor{
+		fenceLegacyCode,
+		expandWikiLinks,
+		expandShortcodes,
+		markTOC,
+	}
+	Postprocessors = []Postprocessor{
+		placeShortcodes,
+		highlightCode,
+		collectHeadings,
+		renderTOC,
+	}
+}
+
+// An entry in a page's table of contents, Title is escaped text.
+type TOCEntry struct {
+	Level    int         `json:"level"`
+	ID       string      `json:"id"`
+	Title    string      `json:"title"`
+	Children []*TOCEntry `json:"children,omitempty"`
+}
+
+// Rendered as a paragraph of its own, so easy to find in the HTML.
+const tocPlaceholder = "ICARUSTABLEOFCONTENTS"
+
+var legacyCodeLine = regexp.MustCompile(`^(?:    |\t):::([\w+#.-]+)[ \t]*$`)
+var codeBlock = regexp.MustCompile(`(?s)<pre><code class="(?:language-)?([^"]+)">(.*?)</code></pre>\n?`)
+var tocLine = regexp.MustCompile(`(?m)^[ \t]*\[TOC\][ \t]*$`)
+var tocParagraph = regexp.MustCompile(`<p>` + tocPlaceholder + `</p>\n?`)
+var headingTag = regexp.MustCompile(`(?s)<h([1-6])([^>]*)>(.*?)</h[1-6]>`)
+var headingIDAttr = regexp.MustCompile(`\sid="([^"]*)"`)
+var htmlTag = regexp.MustCompile(`<[^>]*>`)
+var nonSlug = regexp.MustCompile(`[^\w\s-]`)
+var slugSeparators = regexp.MustCompile(`[-\s]+`)
+var idCount = regexp.MustCompile(`^(.*)_([0-9]+)$`)
+
+// Render Markdown to HTML, running it through the pre and postprocessors.
+func renderMarkdownContent(ctx *RenderContext, content string) (string, error) {
+	rendered, err := renderMarkdownFragment(ctx, content)
+	if err != nil {
+		return "", err
+	}
+	for _, post := range Postprocessors {
+		rendered, err = post(ctx, rendered)
+		if err != nil {
+			return "", err
+		}
+	}
+	return rendered, nil
+}
+
+/*
+Render part of a page's Markdown, such as a shortcode's contents, through
+the preprocessors only, leaving the postprocessors to run once over the
+whole page.
+*/
+func renderMarkdownFragment(ctx *RenderContext, content string) (string, error) {
+	for _, pre := range Preprocessors {
+		var err error
+		content, err = pre(ctx, content)
+		if err != nil {
+			return "", err
+		}
+	}
+	return string(blackfriday.MarkdownCommon([]byte(content))), nil
+}
+
+/*
+Rewrite indented code blocks starting with a :::lang line, the
+Python Markdown codehilite convention, into fenced ```lang blocks.
+*/
+func fenceLegacyCode(ctx *RenderContext, content string) (string, error) {
+	lines := strings.Split(content, "\n")
+	out := make([]string, 0, len(lines))
+	for i := 0; i < len(lines); i++ {
+		m := legacyCodeLine.FindStringSubmatch(lines[i])
+		if m == nil || (i > 0 && strings.TrimSpace(lines[i-1]) != "") {
+			out = append(out, lines[i])
+			continue
+		}
+		// the block runs until the first unindented line, less trailing blanks
+		end := i + 1
+		last := i
+		for ; end < len(lines); end++ {
+			if strings.TrimSpace(lines[end]) == "" {
+				continue
+			}
+			if !strings.HasPrefix(lines[end], "    ") && !strings.HasPrefix(lines[end], "\t") {
+				break
+			}
+			last = end
+		}
+		out = append(out, "```"+m[1])
+		for _, line := range lines[i+1 : last+1] {
+			if strings.HasPrefix(line, "\t") {
+				line = line[1:]
+			} else if strings.HasPrefix(line, "    ") {
+				line = line[4:]
+			}
+			out = append(out, line)
+		}
+		out = append(out, "```")
+		i = last
+	}
+	return strings.Join(out, "\n"), nil
+}
+
+// Highlight code blocks which have a language.
+func highlightCode(ctx *RenderContext, content string) (string, error) {
+	return codeBlock.ReplaceAllStringFunc(content, func(block string) string {
+		m := codeBlock.FindStringSubmatch(block)
+		return Highlight(m[1], html.UnescapeString(m[2]))
+	}), nil
+}
+
+// Swap [TOC] for a placeholder which renderTOC replaces after rendering.
+func markTOC(ctx *RenderContext, content string) (string, error) {
+	return tocLine.ReplaceAllString(content, tocPlaceholder), nil
+}
+
+// Accented letters folded to ASCII, as NFKD normalization does.
+var asciiFolds = strings.NewReplacer(
+	"À", "A", "Á", "A", "Â", "A", "Ã", "A", "Ä", "A", "Å", "A", "Ç", "C",
+	"È", "E", "É", "E", "Ê", "E", "Ë", "E", "Ì", "I", "Í", "I", "Î", "I", "Ï", "I",
+	"Ñ", "N", "Ò", "O", "Ó", "O", "Ô", "O", "Õ", "O", "Ö", "O",
+	"Ù", "U", "Ú", "U", "Û", "U", "Ü", "U", "Ý", "Y",
+	"à", "a", "á", "a", "â", "a", "ã", "a", "ä", "a", "å", "a", "ç", "c",
+	"è", "e", "é", "e", "ê", "e", "ë", "e", "ì", "i", "í", "i", "î", "i", "ï", "i",
+	"ñ", "n", "ò", "o", "ó", "o", "ô", "o", "õ", "o", "ö", "o",
+	"ù", "u", "ú", "u", "û", "u", "ü", "u", "ý", "y", "ÿ", "y",
+)
+
+/*
+Generate an id for a heading from its HTML, the same way Python
+Markdown's headerid and toc extensions did, so links to sections
+of pages rendered by Sisyphus keep working.
+*/
+func headingID(title string) string {
+	text := asciiFolds.Replace(html.UnescapeString(htmlTag.ReplaceAllString(title, "")))
+	text = strings.ToLower(strings.TrimSpace(nonSlug.ReplaceAllString(text, "")))
+	return slugSeparators.ReplaceAllString(text, "-")
+}
+
+// Make an id unique by appending _1, _2 and so on, like headerid.
+func uniqueID(id string, seen map[string]bool) string {
+	for id == "" || seen[id] {
+		if m := idCount.FindStringSubmatch(id); m != nil {
+			n, _ := strconv.Atoi(m[2])
+			id = fmt.Sprintf("%v_%v", m[1], n+1)
+		} else {
+			id = id + "_1"
+		}
+	}
+	return id
+}
+
+/*
+Give every heading an id, keeping any it already has, and collect
+them into the page's table of contents. Ids are generated in document
+order, so they're stable as long as the headings before them are.
+*/
+func collectHeadings(ctx *RenderContext, content string) (string, error) {
+	seen := make(map[string]bool)
+	entries := []*TOCEntry{}
+	content = headingTag.ReplaceAllStringFunc(content, func(h string) string {
+		match := headingTag.FindStringSubmatch(h)
+		level := int(match[1][0] - '0')
+		attrs, title := match[2], match[3]
+		id := ""
+		if m := headingIDAttr.FindStringSubmatch(attrs); m != nil {
+			id = m[1]
+		} else {
+			id = uniqueID(headingID(title), seen)
+			attrs = fmt.Sprintf(` id="%v"`, id) + attrs
+		}
+		seen[id] = true
+		entries = append(entries, &TOCEntry{Level: level, ID: id, Title: strings.TrimSpace(htmlTag.ReplaceAllString(title, ""))})
+		anchor := ""
+		if headingAnchors && !strings.Contains(title, `class="headerlink"`) {
+			anchor = fmt.Sprintf(`<a class="headerlink" href="#%v" title="Permanent link">&para;</a>`, id)
+		}
+		return fmt.Sprintf("<h%v%v>%v%v</h%v>", level, attrs, title, anchor, level)
+	})
+	ctx.Page.TOC = nestTOC(entries)
+	return content, nil
+}
+
+// Nest a flat list of headings under the nearest preceding higher level heading.
+func nestTOC(entries []*TOCEntry) []*TOCEntry {
+	root := &TOCEntry{Level: 0}
+	stack := []*TOCEntry{root}
+	for _, e := range entries {
+		for len(stack) > 1 && stack[len(stack)-1].Level >= e.Level {
+			stack = stack[:len(stack)-1]
+		}
+		parent := stack[len(stack)-1]
+		parent.Children = append(parent.Children, e)
+		stack = append(stack, e)
+	}
+	return root.Children
+}
+
+func writeTOC(b *bytes.Buffer, entries []*TOCEntry) {
+	if len(entries) == 0 {
+		return
+	}
+	b.WriteString("<ul>\n")
+	for _, e := range entries {
+		fmt.Fprintf(b, `<li><a href="#%v">%v</a>`, e.ID, e.Title)
+		writeTOC(b, e.Children)
+		b.WriteString("</li>\n")
+	}
+	b.WriteString("</ul>\n")
+}
+
+// Render a table of contents as HTML, in the same style as Python Markdown's toc.
+func TOCHTML(entries []*TOCEntry) string {
+	var b bytes.Buffer
+	b.WriteString(`<div class="toc">` + "\n")
+	writeTOC(&b, entries)
+	b.WriteString("</div>\n")
+	return b.String()
+}
+
+// Replace the [TOC] placeholder with the page's table of contents.
+func renderTOC(ctx *RenderContext, content string) (string, error) {
+	if !strings.Contains(content, tocPlaceholder) {
+		return content, nil
+	}
+	content = tocParagraph.ReplaceAllLiteralString(content, TOCHTML(ctx.Page.TOC))
+	// anything left was inside a code block or inline
+	return strings.Replace(content, tocPlaceholder, "[TOC]", -1), nil
+}
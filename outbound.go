@@ -0,0 +1,150 @@
+// Tracking clicks on links from pages to other sites.
+package icarus
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const OutboundBackoff = "analytics.backoff.out.%v"
+const OutboundHosts = "analytics.out_host"
+const PageOutboundHosts = "analytics.out_host.%v"
+const PageOutboundLinks = "analytics.out_link.%v"
+const OutboundPath = "/out/"
+
+var anchorHref = regexp.MustCompile(`(<a\s[^>]*?href=")([^"]*)(")`)
+
+// Rewrite outbound links through the /out/ redirect endpoint.
+var trackOutbound = false
+
+func ConfigOutbound(cfg *Config) error {
+	trackOutbound = cfg.Analytics.TrackOutbound
+	return nil
+}
+
+// Parse a link, returning nil if it doesn't point at another site.
+func outboundURL(cfg *Config, link string) *url.URL {
+	u, err := url.Parse(link)
+	if err != nil {
+		return nil
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil
+	}
+	if u.Host == "" || isSiteHost(u.Hostname(), cfg.Server.Domain) {
+		return nil
+	}
+	return u
+}
+
+// Check a host, without its port, is the site's domain or one of its subdomains.
+func isSiteHost(host string, domain string) bool {
+	host, domain = strings.ToLower(host), strings.ToLower(domain)
+	return domain != "" && (host == domain || strings.HasSuffix(host, "."+domain))
+}
+
+// Find every outbound link in content.
+func OutboundLinks(cfg *Config, content string) []string {
+	links := []string{}
+	for _, match := range anchorHref.FindAllStringSubmatch(content, -1) {
+		if u := outboundURL(cfg, html.UnescapeString(match[2])); u != nil {
+			links = append(links, u.String())
+		}
+	}
+	return links
+}
+
+// Rewrite outbound anchors in a page's content to go via OutboundPath.
+func RewriteOutboundLinks(cfg *Config, p *Page) string {
+	return anchorHref.ReplaceAllStringFunc(p.Content, func(anchor string) string {
+		match := anchorHref.FindStringSubmatch(anchor)
+		u := outboundURL(cfg, html.UnescapeString(match[2]))
+		if u == nil {
+			return anchor
+		}
+		q := url.Values{}
+		q.Set("from", p.Slug)
+		q.Set("to", u.String())
+		href := OutboundPath + "?" + q.Encode()
+		return match[1] + html.EscapeString(href) + match[3]
+	})
+}
+
+// Record a click from a page through to an outbound link.
+func TrackOutbound(p *Page, link *url.URL, r *http.Request) error {
+	if shouldIgnore(p, r, OutboundBackoff) {
+		return nil
+	}
+	rc, err := GetRedisClient()
+	defer PutRedisClient(rc)
+	if err != nil {
+		return err
+	}
+	host := strings.ToLower(link.Host)
+	counts := map[string]string{
+		OutboundHosts:                          host,
+		fmt.Sprintf(PageOutboundHosts, p.Slug): host,
+		fmt.Sprintf(PageOutboundLinks, p.Slug): link.String(),
+	}
+	for key, member := range counts {
+		err := rc.Cmd("ZINCRBY", key, 1, member).Err
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Top outbound links for a page, or top outbound hosts across the
+site if slug is empty.
+*/
+func TopOutbound(slug string, count int) ([]Counted, error) {
+	if slug == "" {
+		return TopCounts(OutboundHosts, count)
+	}
+	return TopCounts(fmt.Sprintf(PageOutboundLinks, slug), count)
+}
+
+/*
+Build http.HandlerFunc which records outbound clicks and redirects.
+
+Only links which actually appear in the originating page are followed,
+so this can't be used as an open redirect.
+*/
+func makeOutboundHandler(cfg *Config) http.HandlerFunc {
+	handle := func(w http.ResponseWriter, r *http.Request) {
+		from := r.URL.Query().Get("from")
+		to := r.URL.Query().Get("to")
+		p, err := PageFromRedis(from)
+		if err != nil {
+			notFoundPage(w, r, cfg, err)
+			return
+		}
+		link := outboundURL(cfg, to)
+		found := false
+		if link != nil {
+			for _, l := range OutboundLinks(cfg, p.Content) {
+				if l == link.String() {
+					found = true
+					break
+				}
+			}
+		}
+		if !found {
+			notFoundPage(w, r, cfg, fmt.Errorf("%v doesn't link to %v", from, to))
+			return
+		}
+		http.Redirect(w, r, link.String(), http.StatusFound)
+		err = TrackOutbound(p, link, r)
+		if err != nil {
+			log.Printf("error tracking outbound link: %v", err)
+		}
+	}
+	return handle
+}
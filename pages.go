@@ -69,14 +69,19 @@ func PageFromRedis(slug string) (*Page, error) {
 }
 
 type Page struct {
-	Slug        string   `json:"slug"`
-	Tags        []string `json:"tags"`
-	Title       string   `json:"title"`
-	Summary     string   `json:"summary"`
-	Content     string   `json:"html"`
-	Draft       bool     `json:"draft"`
-	PubDateStr  int64    `json:"pub_date"`
-	EditDateStr int64    `json:"edit_date"`
+	Slug        string      `json:"slug"`
+	Tags        []string    `json:"tags"`
+	Title       string      `json:"title"`
+	Summary     string      `json:"summary"`
+	Content     string      `json:"html"`
+	Draft       bool        `json:"draft"`
+	PubDateStr  int64       `json:"pub_date"`
+	EditDateStr int64       `json:"edit_date"`
+	TOC         []*TOCEntry `json:"toc,omitempty"`
+	WordCount   int         `json:"word_count"`
+	ReadingTime int         `json:"reading_time"`
+	LeadImage   string      `json:"lead_image"`
+	Thumbnail   string      `json:"thumbnail"`
 }
 
 // Generate the Redis key for this page.
@@ -100,6 +105,10 @@ func (p *Page) Sync() error {
 	if err != nil {
 		return err
 	}
+	err = RegisterLinks(p)
+	if err != nil {
+		return err
+	}
 	if !p.Draft {
 		err := RegisterPage(p)
 		if err != nil {
@@ -119,14 +128,17 @@ func (p *Page) Sync() error {
 		if err != nil {
 			return err
 		}
+		err = UnregisterCoViews(p)
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
 func (p *Page) getDate(date int64) time.Time {
-	t := time.Unix(date, 0)
-	return t
+	return SiteTime(time.Unix(date, 0))
 }
 
 func (p *Page) PubDate() time.Time {
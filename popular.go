@@ -0,0 +1,200 @@
+// Lists of the most viewed pages over rolling windows.
+package icarus
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"strconv"
+
+	"github.com/mediocregopher/radix.v2/redis"
+)
+
+const PageZsetByViews = "pages_by_views.%v"
+const PageZsetByViewsBuilt = "pages_by_views.%v.built"
+const PageZsetByViewsBuilding = "pages_by_views.%v.building.%v.%v"
+const TagPagesZsetByViews = "tag_pages_by_views.%v.%v"
+const PopularPagesExpire = 60 * 10
+const DefaultPopularWindow = "week"
+
+// Number of days in each popularity window.
+var PopularWindows = map[string]int{
+	"day":   1,
+	"week":  7,
+	"month": 30,
+	"year":  365,
+}
+
+var popularTitles = map[string]string{
+	"day":   "Most Read Today",
+	"week":  "Most Read This Week",
+	"month": "Most Read This Month",
+	"year":  "Most Read This Year",
+}
+
+// Days in a window, if it's known and within the retention period.
+func popularWindowDays(window string) (int, error) {
+	days, ok := PopularWindows[window]
+	if !ok {
+		return 0, fmt.Errorf("unknown popularity window %v", window)
+	}
+	if retentionDays != 0 && days > retentionDays {
+		return 0, fmt.Errorf("popularity window %v needs %v days of daily detail but retention_days is %v", window, days, retentionDays)
+	}
+	return days, nil
+}
+
+/*
+Build the list of pages by views over a window, returning its key.
+
+Lists are summed from each page's daily page view buckets and cached
+for PopularPagesExpire seconds, so are a few minutes behind. They're
+built into a temporary key which is renamed into place in the same
+transaction which marks them built, so concurrent readers see either
+the old list or the new one. Windows longer than the retention period
+are refused, since their older days have been pruned.
+*/
+func PopularList(window string) (string, error) {
+	days, err := popularWindowDays(window)
+	if err != nil {
+		return "", err
+	}
+	key := fmt.Sprintf(PageZsetByViews, window)
+	rc, err := GetRedisClient()
+	defer PutRedisClient(rc)
+	if err != nil {
+		return key, err
+	}
+	// empty lists can't be stored, so whether it's built is kept alongside
+	built := fmt.Sprintf(PageZsetByViewsBuilt, window)
+	exists, err := rc.Cmd("EXISTS", built).Int()
+	if err != nil || exists == 1 {
+		return key, err
+	}
+
+	slugs, err := rc.Cmd("ZRANGE", PageZsetByTime, 0, -1).List()
+	if err != nil {
+		return key, err
+	}
+	for _, slug := range slugs {
+		rc.PipeAppend("ZRANGE", fmt.Sprintf(PageViewPageBucket, slug), 0, -1, "WITHSCORES")
+	}
+	first := timebucket(DaySeconds) - days + 1
+	args := []interface{}{key}
+	for _, slug := range slugs {
+		raw, err := rc.PipeResp().List()
+		if err != nil {
+			rc.PipeClear()
+			return key, err
+		}
+		total := 0
+		for i := 0; i+1 < len(raw); i += 2 {
+			bucket, err := strconv.Atoi(raw[i])
+			if err != nil || bucket < first {
+				continue
+			}
+			count, err := strconv.ParseFloat(raw[i+1], 64)
+			if err != nil {
+				log.Printf("skipping malformed count for %v in %v", raw[i], slug)
+				continue
+			}
+			total += int(count)
+		}
+		if total > 0 {
+			args = append(args, total, slug)
+		}
+	}
+	// build into a temporary key so readers never see a partial list
+	tmp := fmt.Sprintf(PageZsetByViewsBuilding, window, CurrentTimestamp(), rand.Int63())
+	if len(args) > 1 {
+		args[0] = tmp
+		err = rc.Cmd("ZADD", args...).Err
+		if err != nil {
+			return key, err
+		}
+		err = rc.Cmd("EXPIRE", tmp, PopularPagesExpire).Err
+		if err != nil {
+			return key, err
+		}
+	}
+	err = rc.Cmd("MULTI").Err
+	if err != nil {
+		return key, err
+	}
+	err = queuePopularSwap(rc, key, tmp, built, len(args) > 1)
+	if err != nil {
+		rc.Cmd("DISCARD")
+		return key, err
+	}
+	return key, rc.Cmd("EXEC").Err
+}
+
+// Queue replacing a popular list with its rebuilt copy, expiring along with its built flag.
+func queuePopularSwap(rc *redis.Client, key string, tmp string, built string, nonEmpty bool) error {
+	if nonEmpty {
+		err := rc.Cmd("RENAME", tmp, key).Err
+		if err != nil {
+			return err
+		}
+		err = rc.Cmd("EXPIRE", key, PopularPagesExpire).Err
+		if err != nil {
+			return err
+		}
+	} else {
+		err := rc.Cmd("DEL", key).Err
+		if err != nil {
+			return err
+		}
+	}
+	return rc.Cmd("SET", built, 1, "EX", PopularPagesExpire).Err
+}
+
+// Build the list of pages in a tag by views over a window, returning its key.
+func TagPopularList(tag string, window string) (string, error) {
+	popularKey, err := PopularList(window)
+	if err != nil {
+		return "", err
+	}
+	key := fmt.Sprintf(TagPagesZsetByViews, tag, window)
+	rc, err := GetRedisClient()
+	defer PutRedisClient(rc)
+	if err != nil {
+		return key, err
+	}
+	exists, err := rc.Cmd("EXISTS", key).Int()
+	if err != nil || exists == 1 {
+		return key, err
+	}
+	err = rc.Cmd("MULTI").Err
+	if err != nil {
+		return key, err
+	}
+	// weight the tag's pages at zero so scores are just the views
+	err = rc.Cmd("ZINTERSTORE", key, 2, popularKey, fmt.Sprintf(TagPagesZsetByTime, tag), "WEIGHTS", 1, 0).Err
+	if err != nil {
+		rc.Cmd("DISCARD")
+		return key, err
+	}
+	err = rc.Cmd("EXPIRE", key, PopularPagesExpire).Err
+	if err != nil {
+		rc.Cmd("DISCARD")
+		return key, err
+	}
+	return key, rc.Cmd("EXEC").Err
+}
+
+func PopularPages(window string, offset int, count int) ([]*Page, error) {
+	key, err := PopularList(window)
+	if err != nil {
+		return []*Page{}, err
+	}
+	return PagesForList(key, offset, count, true)
+}
+
+func TagPopularPages(tag string, window string, offset int, count int) ([]*Page, error) {
+	key, err := TagPopularList(tag, window)
+	if err != nil {
+		return []*Page{}, err
+	}
+	return PagesForList(key, offset, count, true)
+}
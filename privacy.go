@@ -0,0 +1,318 @@
+// Limiting what analytics store about readers.
+package icarus
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mediocregopher/radix.v2/redis"
+)
+
+const AnalyticsSalt = "analytics.salt.%v"
+const ConsentCookie = "analytics_consent"
+const ConsentPath = "/consent/"
+const ConsentExpire = 60 * 60 * 24 * 365
+
+const AnonymizeNone = ""
+const AnonymizeTruncate = "truncate"
+const AnonymizeHash = "hash"
+
+var anonymizeIPs = AnonymizeNone
+var reduceUserAgents = false
+var requireConsent = false
+
+// The salt for hashing IPs is shared through Redis and rotated daily.
+var saltLock sync.Mutex
+var saltBucket = 0
+var salt = ""
+
+func ConfigPrivacy(cfg *Config) error {
+	switch cfg.Privacy.AnonymizeIPs {
+	case AnonymizeNone, AnonymizeTruncate, AnonymizeHash:
+		anonymizeIPs = cfg.Privacy.AnonymizeIPs
+	default:
+		return fmt.Errorf("unknown anonymize_ips %v, must be truncate or hash", cfg.Privacy.AnonymizeIPs)
+	}
+	reduceUserAgents = cfg.Privacy.ReduceUserAgents
+	requireConsent = cfg.Privacy.RequireConsent
+	return nil
+}
+
+// Retrieve today's salt, creating it if no process has yet.
+func currentSalt() (string, error) {
+	saltLock.Lock()
+	defer saltLock.Unlock()
+	bucket := timebucket(DaySeconds)
+	if bucket == saltBucket && salt != "" {
+		return salt, nil
+	}
+	rc, err := GetRedisClient()
+	defer PutRedisClient(rc)
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	key := fmt.Sprintf(AnalyticsSalt, bucket)
+	err = rc.Cmd("SET", key, hex.EncodeToString(buf), "NX", "EX", 2*DaySeconds).Err
+	if err != nil {
+		return "", err
+	}
+	s, err := rc.Cmd("GET", key).Str()
+	if err != nil {
+		return "", err
+	}
+	saltBucket, salt = bucket, s
+	return salt, nil
+}
+
+// Truncate an IP to its /24 (IPv4) or /48 (IPv6) network.
+func TruncateIP(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return "invalid"
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return parsed.Mask(net.CIDRMask(48, 128)).String()
+}
+
+/*
+Retrieve the reader's IP, anonymized according to the privacy config.
+
+This is what should be stored, or used to build keys, rather than GetIP.
+*/
+func AnonymizedIP(r *http.Request) string {
+	ip := GetIP(r)
+	switch anonymizeIPs {
+	case AnonymizeTruncate:
+		return TruncateIP(ip)
+	case AnonymizeHash:
+		hashed, err := hashIP(ip)
+		if err != nil {
+			// better to lump readers together than store the raw IP
+			log.Printf("error retrieving salt, truncating IP instead: %v", err)
+			return TruncateIP(ip)
+		}
+		return hashed
+	}
+	return ip
+}
+
+// HMAC an IP with today's salt.
+func hashIP(ip string) (string, error) {
+	s, err := currentSalt()
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, []byte(s))
+	mac.Write([]byte(ip))
+	return hex.EncodeToString(mac.Sum(nil)[:16]), nil
+}
+
+/*
+Identify the reader in rate limiting keys.
+
+Unlike AnonymizedIP this never lumps a network together, so each
+reader has their own budget, but the IP is still hashed unless IPs
+are configured to be stored as-is.
+*/
+func RateLimitIP(r *http.Request) string {
+	ip := GetIP(r)
+	if anonymizeIPs == AnonymizeNone {
+		return ip
+	}
+	hashed, err := hashIP(ip)
+	if err != nil {
+		// the keys only last a minute, so an unsalted hash will do
+		log.Printf("error retrieving salt, hashing IP without it: %v", err)
+		h := sha256.Sum256([]byte(ip))
+		return hex.EncodeToString(h[:16])
+	}
+	return hashed
+}
+
+// Browser families, checked in order since many user agents claim to be several.
+var userAgentFamilies = []struct {
+	Match  string
+	Family string
+}{
+	{"edg/", "Edge"},
+	{"edge/", "Edge"},
+	{"opr/", "Opera"},
+	{"opera", "Opera"},
+	{"firefox/", "Firefox"},
+	{"chromium/", "Chromium"},
+	{"crios/", "Chrome"},
+	{"chrome/", "Chrome"},
+	{"safari/", "Safari"},
+	{"msie ", "Internet Explorer"},
+	{"trident/", "Internet Explorer"},
+	{"curl/", "curl"},
+	{"wget/", "Wget"},
+}
+
+// Reduce a user agent string to its browser family.
+func UserAgentFamily(ua string) string {
+	lua := strings.ToLower(ua)
+	for _, f := range userAgentFamilies {
+		if strings.Contains(lua, f.Match) {
+			return f.Family
+		}
+	}
+	return "Other"
+}
+
+// The user agent to store for a request, per the privacy config.
+func StoredUserAgent(r *http.Request) string {
+	if reduceUserAgents {
+		return UserAgentFamily(r.UserAgent())
+	}
+	return r.UserAgent()
+}
+
+// Check for Do Not Track or Global Privacy Control.
+func OptedOut(r *http.Request) bool {
+	return r.Header.Get("DNT") == "1" || r.Header.Get("Sec-GPC") == "1"
+}
+
+// Check if the reader has consented to analytics, when consent is required.
+func HasConsent(r *http.Request) bool {
+	if !requireConsent {
+		return true
+	}
+	c, err := r.Cookie(ConsentCookie)
+	return err == nil && c.Value == "yes"
+}
+
+// Check if we should ask the reader for consent.
+func AskConsent(r *http.Request) bool {
+	if !requireConsent || OptedOut(r) {
+		return false
+	}
+	_, err := r.Cookie(ConsentCookie)
+	return err != nil
+}
+
+// Build http.HandlerFunc which records the reader's analytics consent choice.
+func makeConsentHandler(cfg *Config) http.HandlerFunc {
+	handle := func(w http.ResponseWriter, r *http.Request) {
+		choice := "no"
+		if r.URL.Query().Get("choice") == "yes" {
+			choice = "yes"
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     ConsentCookie,
+			Value:    choice,
+			Path:     "/",
+			MaxAge:   ConsentExpire,
+			Expires:  time.Now().Add(ConsentExpire * time.Second),
+			HttpOnly: true,
+		})
+		// only redirect within this site
+		next := "/"
+		if u, err := url.Parse(r.URL.Query().Get("next")); err == nil && u.Host == "" && strings.HasPrefix(u.Path, "/") && !strings.HasPrefix(u.Path, "//") {
+			next = u.RequestURI()
+		}
+		http.Redirect(w, r, next, http.StatusFound)
+	}
+	return handle
+}
+
+// Delete every key matching a pattern, returning how many were deleted.
+func deleteMatching(rc *redis.Client, pattern string) (int, error) {
+	cursor := "0"
+	deleted := 0
+	for {
+		resp, err := rc.Cmd("SCAN", cursor, "MATCH", pattern, "COUNT", 1000).Array()
+		if err != nil {
+			return deleted, err
+		}
+		if len(resp) != 2 {
+			return deleted, fmt.Errorf("unexpected SCAN response")
+		}
+		cursor, err = resp[0].Str()
+		if err != nil {
+			return deleted, err
+		}
+		keys, err := resp[1].List()
+		if err != nil {
+			return deleted, err
+		}
+		if len(keys) > 0 {
+			n, err := rc.Cmd("DEL", keys).Int()
+			if err != nil {
+				return deleted, err
+			}
+			deleted += n
+		}
+		if cursor == "0" {
+			return deleted, nil
+		}
+	}
+}
+
+/*
+Purge data which the privacy config says shouldn't be kept.
+
+This reduces stored user agents to browser families if ReduceUserAgents
+is set, removes any outstanding rate limiting keys (which are named
+by IP) and prunes per-page daily detail past the retention period.
+*/
+func PurgeAnalytics() error {
+	rc, err := GetRedisClient()
+	defer PutRedisClient(rc)
+	if err != nil {
+		return err
+	}
+	if reduceUserAgents {
+		agents, err := TopCounts(UserAgents, -1)
+		if err != nil {
+			return err
+		}
+		families := make(map[string]int)
+		for _, agent := range agents {
+			families[UserAgentFamily(agent.Key)] += agent.Count
+		}
+		err = rc.Cmd("DEL", UserAgents).Err
+		if err != nil {
+			return err
+		}
+		for family, count := range families {
+			err := rc.Cmd("ZINCRBY", UserAgents, count, family).Err
+			if err != nil {
+				return err
+			}
+		}
+		log.Printf("reduced %v user agents to %v families", len(agents), len(families))
+	}
+
+	deleted := 0
+	for _, pattern := range []string{fmt.Sprintf(AnalyticsBackoff, "*"), fmt.Sprintf(RateLimitKey, "*", "*")} {
+		n, err := deleteMatching(rc, pattern)
+		if err != nil {
+			return err
+		}
+		deleted += n
+	}
+	log.Printf("deleted %v rate limiting keys", deleted)
+
+	if retentionDays == 0 {
+		log.Printf("no retention_days configured, keeping daily detail")
+		return nil
+	}
+	return Rollup()
+}
@@ -0,0 +1,118 @@
+// Fixed window rate limiting backed by Redis.
+package icarus
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/mediocregopher/radix.v2/redis"
+)
+
+const RateLimitKey = "ratelimit.%v.%v"
+
+// Increment the window's counter, starting the window on the first request.
+const rateLimitScript = `local current = redis.call("incr", KEYS[1])
+if tonumber(current) == 1 then
+    redis.call("expire", KEYS[1], ARGV[1])
+end
+return current
+`
+
+var rateLimitScriptSHA = scriptSHA(rateLimitScript)
+
+func scriptSHA(script string) string {
+	h := sha1.Sum([]byte(script))
+	return hex.EncodeToString(h[:])
+}
+
+/*
+Run a Lua script via EVALSHA so it is only sent to Redis once,
+falling back to EVAL (which caches it) if Redis doesn't have it.
+*/
+func runScript(rc *redis.Client, script string, sha string, args ...interface{}) *redis.Resp {
+	resp := rc.Cmd("EVALSHA", append([]interface{}{sha}, args...)...)
+	if resp.Err != nil && strings.HasPrefix(resp.Err.Error(), "NOSCRIPT") {
+		resp = rc.Cmd("EVAL", append([]interface{}{script}, args...)...)
+	}
+	return resp
+}
+
+/*
+Allow up to Budget requests per key every Window seconds.
+
+If Redis can't be reached, requests are allowed when FailOpen is set
+and limited otherwise.
+*/
+type RateLimiter struct {
+	Name     string
+	Window   int
+	Budget   int
+	FailOpen bool
+}
+
+func NewRateLimiter(name string, cfg RateLimitConfig) *RateLimiter {
+	rl := &RateLimiter{Name: name, Window: cfg.Window, Budget: cfg.Budget, FailOpen: cfg.FailOpen}
+	if rl.Window <= 0 {
+		rl.Window = RateLimitPeriod
+	}
+	if rl.Budget <= 0 {
+		rl.Budget = 1
+	}
+	return rl
+}
+
+func (rl *RateLimiter) failed(err error) bool {
+	if rl.FailOpen {
+		log.Printf("error checking %v ratelimit, allowing request: %v", rl.Name, err)
+	} else {
+		log.Printf("error checking %v ratelimit, limiting request: %v", rl.Name, err)
+	}
+	return !rl.FailOpen
+}
+
+// Count a request against key, returning true if it is over budget.
+func (rl *RateLimiter) Limited(key string) bool {
+	rc, err := GetRedisClient()
+	defer PutRedisClient(rc)
+	if err != nil {
+		return rl.failed(err)
+	}
+	current, err := runScript(rc, rateLimitScript, rateLimitScriptSHA, 1, key, rl.Window).Int()
+	if err != nil {
+		return rl.failed(err)
+	}
+	return current > rl.Budget
+}
+
+/*
+Wrap a handler, responding 429 to readers who are over budget. Readers
+are identified by RateLimitIP, so each has their own budget.
+*/
+func (rl *RateLimiter) Middleware(h http.HandlerFunc) http.HandlerFunc {
+	handle := func(w http.ResponseWriter, r *http.Request) {
+		key := fmt.Sprintf(RateLimitKey, rl.Name, RateLimitIP(r))
+		if rl.Limited(key) {
+			w.Header().Set("Retry-After", strconv.Itoa(rl.Window))
+			http.Error(w, "too many requests, please slow down", http.StatusTooManyRequests)
+			return
+		}
+		h(w, r)
+	}
+	return handle
+}
+
+/*
+Apply the rate limit configured for name to a handler, if there is one.
+*/
+func rateLimited(cfg *Config, name string, h http.HandlerFunc) http.HandlerFunc {
+	rlc, ok := cfg.RateLimits[name]
+	if !ok {
+		return h
+	}
+	return NewRateLimiter(name, rlc).Middleware(h)
+}
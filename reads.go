@@ -0,0 +1,164 @@
+// Tracking how much of each page readers actually read.
+package icarus
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+const BeaconBackoff = "analytics.backoff.beacon.%v"
+const PageReads = "analytics.read.%v"
+const PageReadDepth = "analytics.read_depth.%v"
+const PageReadTime = "analytics.read_time.%v"
+const BeaconPath = "/beacon/"
+
+// Depth, in percent, at which a page counts as completely read.
+const ReadCompleteDepth = 90
+
+// Engaged time is bucketed into ReadTimeBucket seconds, up to MaxReadTime.
+const ReadTimeBucket = 5
+const MaxReadTime = 60 * 60
+
+// Record one read-depth beacon for a page.
+func TrackRead(p *Page, depth int, seconds int, r *http.Request) error {
+	if shouldIgnore(p, r, BeaconBackoff) {
+		return nil
+	}
+	rc, err := GetRedisClient()
+	defer PutRedisClient(rc)
+	if err != nil {
+		return err
+	}
+	readsKey := fmt.Sprintf(PageReads, p.Slug)
+	err = rc.Cmd("HINCRBY", readsKey, "beacons", 1).Err
+	if err != nil {
+		return err
+	}
+	if depth >= ReadCompleteDepth {
+		err = rc.Cmd("HINCRBY", readsKey, "completed", 1).Err
+		if err != nil {
+			return err
+		}
+	}
+	// depth in quartiles, so 0, 25, 50, 75 or 100
+	err = rc.Cmd("ZINCRBY", fmt.Sprintf(PageReadDepth, p.Slug), 1, depth/25*25).Err
+	if err != nil {
+		return err
+	}
+	bucket := seconds / ReadTimeBucket * ReadTimeBucket
+	return rc.Cmd("ZINCRBY", fmt.Sprintf(PageReadTime, p.Slug), 1, bucket).Err
+}
+
+// How far through, and for how long, a page is read.
+type ReadStats struct {
+	Slug           string
+	Beacons        int
+	Completed      int
+	CompletionRate float64
+	MedianSeconds  int
+	Depths         map[int]int
+}
+
+// Retrieve aggregated read-depth and read time for a page.
+func PageReadStats(slug string) (*ReadStats, error) {
+	rs := &ReadStats{Slug: slug, Depths: make(map[int]int)}
+	rc, err := GetRedisClient()
+	defer PutRedisClient(rc)
+	if err != nil {
+		return rs, err
+	}
+	counts, err := rc.Cmd("HGETALL", fmt.Sprintf(PageReads, slug)).Map()
+	if err != nil {
+		return rs, err
+	}
+	rs.Beacons, _ = strconv.Atoi(counts["beacons"])
+	rs.Completed, _ = strconv.Atoi(counts["completed"])
+	if rs.Beacons > 0 {
+		rs.CompletionRate = float64(rs.Completed) / float64(rs.Beacons)
+	}
+
+	depths, err := TopCounts(fmt.Sprintf(PageReadDepth, slug), -1)
+	if err != nil {
+		return rs, err
+	}
+	for _, d := range depths {
+		depth, err := strconv.Atoi(d.Key)
+		if err != nil {
+			log.Printf("skipping malformed read depth %v for %v", d.Key, slug)
+			continue
+		}
+		rs.Depths[depth] = d.Count
+	}
+
+	// walk the read time histogram in order until we pass the midpoint
+	times, err := TopCounts(fmt.Sprintf(PageReadTime, slug), -1)
+	if err != nil {
+		return rs, err
+	}
+	buckets := make([]int, 0, len(times))
+	histogram := make(map[int]int, len(times))
+	total := 0
+	for _, t := range times {
+		bucket, err := strconv.Atoi(t.Key)
+		if err != nil {
+			log.Printf("skipping malformed read time %v for %v", t.Key, slug)
+			continue
+		}
+		buckets = append(buckets, bucket)
+		histogram[bucket] = t.Count
+		total += t.Count
+	}
+	sort.Ints(buckets)
+	seen := 0
+	for _, bucket := range buckets {
+		seen += histogram[bucket]
+		if seen*2 >= total {
+			rs.MedianSeconds = bucket
+			break
+		}
+	}
+	return rs, nil
+}
+
+/*
+Build http.HandlerFunc which accepts read-depth beacons from page.html.
+
+Beacons are POSTed with slug, depth (percent of the page scrolled
+through) and seconds (engaged time on the page).
+*/
+func makeBeaconHandler(cfg *Config) http.HandlerFunc {
+	handle := func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "beacons must be POSTed", http.StatusMethodNotAllowed)
+			return
+		}
+		depth, err := strconv.Atoi(r.PostFormValue("depth"))
+		if err != nil || depth < 0 || depth > 100 {
+			http.Error(w, "depth must be between 0 and 100", http.StatusBadRequest)
+			return
+		}
+		seconds, err := strconv.Atoi(r.PostFormValue("seconds"))
+		if err != nil || seconds < 0 {
+			http.Error(w, "seconds must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		if seconds > MaxReadTime {
+			seconds = MaxReadTime
+		}
+		p, err := PageFromRedis(r.PostFormValue("slug"))
+		if err != nil {
+			http.Error(w, "no such page", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		err = TrackRead(p, depth, seconds, r)
+		if err != nil {
+			log.Printf("error tracking read: %v", err)
+		}
+	}
+	return handle
+}
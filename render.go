@@ -3,41 +3,65 @@ package icarus
 import (
 	"encoding/json"
 	"fmt"
+	"log"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
-	"github.com/russross/blackfriday"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
 )
 
-func Render(filename string, content string) (*Page, error) {
+/*
+Render a page according to its file's extension. Wiki links in Markdown
+pages can point at wikiPages as well as pages in Redis.
+*/
+func Render(filename string, content string, wikiPages WikiPages) (*Page, error) {
 	switch filepath.Ext(filename) {
 	case ".md":
-		return RenderMarkdown(content)
+		return RenderMarkdown(content, wikiPages)
 	case ".html":
 		return RenderHTML(content)
 	}
 	return nil, fmt.Errorf("filename %v doesn't match any known suffixes", filename)
 }
 
-func RenderMarkdown(content string) (*Page, error) {
+func RenderMarkdown(content string, wikiPages WikiPages) (*Page, error) {
 	//page['html'] = markdown.markdown(page['html'], ['codehilite(css_class=highlight)', 'headerid','toc'])
-	p, content, err := ReadHeaders(content)
+	p, body, err := ReadHeaders(content)
 	if err != nil {
 		return nil, fmt.Errorf("error reading headers: %v", err)
 	}
+	ctx := &RenderContext{Page: p, BodyLine: strings.Count(content[:len(content)-len(body)], "\n"), WikiPages: wikiPages}
+	content = body
 	if p.Slug == "" {
 		return p, fmt.Errorf("skipping %v because it has no slug", p.Title)
 	}
-	p.Content = string(blackfriday.MarkdownCommon([]byte(content)))
+	p.Content, err = renderMarkdownContent(ctx, content)
+	if err != nil {
+		return p, fmt.Errorf("error rendering %v: %v", p.Slug, err)
+	}
+	for _, link := range ctx.brokenLinks {
+		log.Printf("broken wiki link in %v to %v", p.Slug, link)
+	}
+	for _, link := range ctx.unverifiedLinks {
+		log.Printf("couldn't check wiki link in %v to %v", p.Slug, link)
+	}
+	p.Summarize()
 	return p, nil
 }
 
 func RenderHTML(content string) (*Page, error) {
 	p, content, err := ReadHeaders(content)
 	if err != nil {
-		fmt.Errorf("error reading headers: %v", err)
+		return nil, fmt.Errorf("error reading headers: %v", err)
+	}
+	if p.Slug == "" {
+		return p, fmt.Errorf("skipping %v because it has no slug", p.Title)
 	}
 	p.Content = content
+	p.Summarize()
 	return p, nil
 }
 
@@ -54,8 +78,15 @@ Headers look like this:
 Including a \n\n (outside of string) to designate the end of the section.
 In general, you can describe the header as a JSON dictionary without the
 opening or closing {}s.
+
+Headers may instead be YAML front matter between --- lines, or TOML
+front matter between +++ lines, with the same keys.
 */
 func ReadHeaders(content string) (*Page, string, error) {
+	content = strings.TrimPrefix(content, "\ufeff")
+	if hasFrontMatter(content) {
+		return readFrontMatter(content)
+	}
 	head, rest, err := splitHeader(content)
 	if err != nil {
 		return nil, "", err
@@ -79,29 +110,148 @@ func ReadHeaders(content string) (*Page, string, error) {
 	return p, rest, nil
 }
 
+/*
+Find the end of a JSON header, the first blank line which isn't
+inside a string, list or dictionary.
+*/
 func splitHeader(content string) (string, string, error) {
-	stacks := make(map[rune]int)
+	depth := 0
+	inString := false
+	escaped := false
 	var prev rune
 	for i, c := range content {
-		if c == '\n' && prev == '\n' && (stacks['"']%2 == 0) && (stacks['['] == 0) && (stacks['{'] == 0) {
+		if c == '\n' && prev == '\n' && !inString && depth == 0 {
 			return content[:i], content[i:], nil
 		}
-		// ignore escaped things
-		if prev == '\\' {
-			prev = rune(0)
+		prev = c
+		if inString {
+			// ignore escaped things
+			if escaped {
+				escaped = false
+			} else if c == '\\' {
+				escaped = true
+			} else if c == '"' {
+				inString = false
+			}
 			continue
 		}
-
-		// make sure we're not in a quote, list or whatever
 		switch c {
-		case '[', '{', '"':
-			stacks[c] += 1
-		case ']':
-			stacks['['] -= 1
-		case '}':
-			stacks['['] -= 1
+		case '"':
+			inString = true
+		case '[', '{':
+			depth += 1
+		case ']', '}':
+			depth -= 1
 		}
-		prev = c
 	}
 	return "", "", fmt.Errorf("couldn't find header split")
 }
+
+// Headers as they appear in YAML or TOML front matter.
+type frontMatter struct {
+	Slug     string      `yaml:"slug" toml:"slug"`
+	Tags     []string    `yaml:"tags" toml:"tags"`
+	Title    string      `yaml:"title" toml:"title"`
+	Summary  string      `yaml:"summary" toml:"summary"`
+	Draft    bool        `yaml:"draft" toml:"draft"`
+	PubDate  interface{} `yaml:"pub_date" toml:"pub_date"`
+	EditDate interface{} `yaml:"edit_date" toml:"edit_date"`
+}
+
+// Layout for the clock reading of TOML's local dates and times, which have no offset.
+const frontMatterLocalLayout = "2006-01-02T15:04:05.999999999"
+
+var frontMatterDateLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02 15:04", "2006-01-02"}
+
+/*
+Convert a front matter date to a timestamp. Dates may be timestamps,
+as in JSON headers, or dates and times in the blog's timezone unless
+they have an offset.
+*/
+func frontMatterDate(v interface{}) (int64, error) {
+	switch d := v.(type) {
+	case nil:
+		return 0, nil
+	case int:
+		return int64(d), nil
+	case int64:
+		return d, nil
+	case float64:
+		return int64(d), nil
+	case time.Time:
+		// TOML dates and times without an offset are read in the blog's timezone
+		switch d.Location().String() {
+		case "datetime-local", "date-local":
+			t, err := time.ParseInLocation(frontMatterLocalLayout, d.Format(frontMatterLocalLayout), siteLocation)
+			return t.Unix(), err
+		case "time-local":
+			return 0, fmt.Errorf("couldn't parse date %v, it has a time but no date", v)
+		}
+		return d.Unix(), nil
+	case string:
+		if ts, err := strconv.ParseInt(d, 10, 64); err == nil {
+			return ts, nil
+		}
+		for _, layout := range frontMatterDateLayouts {
+			if t, err := time.ParseInLocation(layout, d, siteLocation); err == nil {
+				return t.Unix(), nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("couldn't parse date %v", v)
+}
+
+// Whether content opens with a YAML or TOML front matter delimiter line.
+func hasFrontMatter(content string) bool {
+	for _, delim := range []string{"---", "+++"} {
+		if strings.HasPrefix(content, delim+"\n") || strings.HasPrefix(content, delim+"\r\n") {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Split YAML (between --- lines) or TOML (between +++ lines) front matter
+from the rest of the page, returning the opening delimiter, the front
+matter and the rest.
+*/
+func splitFrontMatter(content string) (string, string, string, error) {
+	delim := content[:3]
+	lines := strings.SplitAfter(content, "\n")
+	for i := 1; i < len(lines); i++ {
+		line := strings.TrimRight(lines[i], " \t\r\n")
+		if line == delim || (delim == "---" && line == "...") {
+			return delim, strings.Join(lines[1:i], ""), strings.Join(lines[i+1:], ""), nil
+		}
+	}
+	return delim, "", "", fmt.Errorf("couldn't find closing %v of front matter", delim)
+}
+
+// Read YAML or TOML front matter.
+func readFrontMatter(content string) (*Page, string, error) {
+	p := &Page{}
+	delim, head, rest, err := splitFrontMatter(content)
+	if err != nil {
+		return p, rest, err
+	}
+	fm := frontMatter{}
+	if delim == "---" {
+		err = yaml.Unmarshal([]byte(head), &fm)
+	} else {
+		_, err = toml.Decode(head, &fm)
+	}
+	if err != nil {
+		return p, rest, err
+	}
+	p.Slug, p.Tags, p.Title, p.Summary, p.Draft = fm.Slug, fm.Tags, fm.Title, fm.Summary, fm.Draft
+	if p.PubDateStr, err = frontMatterDate(fm.PubDate); err != nil {
+		return p, rest, fmt.Errorf("bad pub_date: %v", err)
+	}
+	if p.EditDateStr, err = frontMatterDate(fm.EditDate); err != nil {
+		return p, rest, fmt.Errorf("bad edit_date: %v", err)
+	}
+	p.EnsureEditDate()
+	p.EnsurePubDate()
+	return p, rest, nil
+}
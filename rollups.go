@@ -0,0 +1,447 @@
+// Rolling daily analytics up into weekly, monthly and yearly buckets.
+package icarus
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/mediocregopher/radix.v2/redis"
+)
+
+const RollupWatermark = "analytics.rollup.last"
+const SiteRollupWatermark = "analytics.rollup.last_site"
+const PageRollupWatermark = "analytics.rollup.last_page.%v"
+const RollupLock = "analytics.rollup.lock"
+const RollupLockExpire = 60 * 10
+const PageViewRollup = "analytics.pv_%v"
+const PageViewPageRollup = "analytics.pv_%v.%v"
+const UniqueVisitorRollup = "analytics.uv_%v.%v"
+const PageUniqueVisitorRollup = "analytics.uv_%v.%v.%v"
+const DefaultRollupPeriod = 60 * 60
+const UniqueRollupLookback = 366
+
+var RollupPeriods = []string{"week", "month", "year"}
+
+// Number of days of per-page daily detail to keep, zero keeps everything.
+var retentionDays = 0
+var rollupPeriod = DefaultRollupPeriod
+
+func ConfigRollups(cfg *Config) error {
+	retentionDays = cfg.Analytics.RetentionDays
+	if cfg.Analytics.RollupPeriod != 0 {
+		rollupPeriod = cfg.Analytics.RollupPeriod
+	}
+	return nil
+}
+
+// Label for the period containing a day bucket, e.g. 2016-W20, 2016-05 or 2016.
+func PeriodLabel(period string, bucket int) (string, error) {
+	t := BucketDate(bucket)
+	switch period {
+	case "week":
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%04d-W%02d", year, week), nil
+	case "month":
+		return t.Format("2006-01"), nil
+	case "year":
+		return t.Format("2006"), nil
+	}
+	return "", fmt.Errorf("unknown rollup period %v", period)
+}
+
+// Retrieve the day buckets and counts stored in a daily zset.
+func dailyCounts(key string) (map[int]int, error) {
+	rc, err := GetRedisClient()
+	defer PutRedisClient(rc)
+	if err != nil {
+		return map[int]int{}, err
+	}
+	raw, err := rc.Cmd("ZRANGE", key, 0, -1, "WITHSCORES").List()
+	if err != nil {
+		return map[int]int{}, err
+	}
+	counts := make(map[int]int, len(raw)/2)
+	for i := 0; i+1 < len(raw); i += 2 {
+		bucket, err := strconv.Atoi(raw[i])
+		if err != nil {
+			log.Printf("skipping malformed bucket %v in %v: %v", raw[i], key, err)
+			continue
+		}
+		count, err := strconv.ParseFloat(raw[i+1], 64)
+		if err != nil {
+			log.Printf("skipping malformed count for %v in %v: %v", raw[i], key, err)
+			continue
+		}
+		counts[bucket] = int(count)
+	}
+	return counts, nil
+}
+
+// The rollup zset for a period, for a page or the site if slug is empty.
+func rollupKey(period string, slug string) string {
+	if slug == "" {
+		return fmt.Sprintf(PageViewRollup, period)
+	}
+	return fmt.Sprintf(PageViewPageRollup, period, slug)
+}
+
+func rollupWatermarkKey(slug string) string {
+	if slug == "" {
+		return SiteRollupWatermark
+	}
+	return fmt.Sprintf(PageRollupWatermark, slug)
+}
+
+// Read a day bucket watermark, and whether it has been set.
+func getWatermark(rc *redis.Client, key string) (int, bool, error) {
+	resp := rc.Cmd("GET", key)
+	if resp.IsType(redis.Nil) {
+		return 0, false, nil
+	}
+	s, err := resp.Str()
+	if err != nil {
+		return 0, false, err
+	}
+	watermark, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, false, fmt.Errorf("malformed rollup watermark %v in %v: %v", s, key, err)
+	}
+	return watermark, true, nil
+}
+
+/*
+The last day rolled up for a page, or the site if slug is empty, which
+is RollupWatermark until it has been rolled up on its own.
+*/
+func rollupWatermark(rc *redis.Client, slug string) (int, error) {
+	watermark, ok, err := getWatermark(rc, rollupWatermarkKey(slug))
+	if ok || err != nil {
+		return watermark, err
+	}
+	watermark, _, err = getWatermark(rc, RollupWatermark)
+	return watermark, err
+}
+
+/*
+Add the page views for days after the watermark, up to and including
+to, onto the rollups for a page, or the site if slug is empty.
+
+The increments and the new watermark are written in one transaction
+which watches the watermark, so a day is never added twice, even if a
+run fails partway through or overlaps with another run.
+*/
+func rollupViews(slug string, to int) error {
+	dailyKey := PageViewBucket
+	if slug != "" {
+		dailyKey = fmt.Sprintf(PageViewPageBucket, slug)
+	}
+	rc, err := GetRedisClient()
+	defer PutRedisClient(rc)
+	if err != nil {
+		return err
+	}
+	watermarkKey := rollupWatermarkKey(slug)
+	err = rc.Cmd("WATCH", watermarkKey, RollupWatermark).Err
+	if err != nil {
+		return err
+	}
+	defer rc.Cmd("UNWATCH")
+	from, err := rollupWatermark(rc, slug)
+	if err != nil || to <= from {
+		return err
+	}
+	counts, err := dailyCounts(dailyKey)
+	if err != nil {
+		return err
+	}
+	totals := make(map[string]map[string]int)
+	for _, period := range RollupPeriods {
+		totals[period] = make(map[string]int)
+		for bucket, count := range counts {
+			if bucket <= from || bucket > to {
+				continue
+			}
+			label, err := PeriodLabel(period, bucket)
+			if err != nil {
+				return err
+			}
+			totals[period][label] += count
+		}
+	}
+	err = rc.Cmd("MULTI").Err
+	if err != nil {
+		return err
+	}
+	for period, labels := range totals {
+		for label, total := range labels {
+			err := rc.Cmd("ZINCRBY", rollupKey(period, slug), total, label).Err
+			if err != nil {
+				rc.Cmd("DISCARD")
+				return err
+			}
+		}
+	}
+	err = rc.Cmd("SET", watermarkKey, to).Err
+	if err != nil {
+		rc.Cmd("DISCARD")
+		return err
+	}
+	resp := rc.Cmd("EXEC")
+	if resp.Err != nil {
+		return resp.Err
+	}
+	if resp.IsType(redis.Nil) {
+		log.Printf("skipping rollup of %v, another rollup moved its watermark", dailyKey)
+	}
+	return nil
+}
+
+// Merge the daily unique visitor HyperLogLogs for days in (from, to].
+func rollupUniques(slug string, from int, to int) error {
+	rc, err := GetRedisClient()
+	defer PutRedisClient(rc)
+	if err != nil {
+		return err
+	}
+	for bucket := from + 1; bucket <= to; bucket++ {
+		day := fmt.Sprintf(UniqueVisitorBucket, bucket)
+		if slug != "" {
+			day = fmt.Sprintf(PageUniqueVisitorBucket, bucket, slug)
+		}
+		for _, period := range RollupPeriods {
+			label, err := PeriodLabel(period, bucket)
+			if err != nil {
+				return err
+			}
+			key := fmt.Sprintf(UniqueVisitorRollup, period, label)
+			if slug != "" {
+				key = fmt.Sprintf(PageUniqueVisitorRollup, period, label, slug)
+			}
+			err = rc.Cmd("PFMERGE", key, key, day).Err
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/*
+Roll up a page, or the site if slug is empty, through to. Uniques are
+merged first since merging them again is harmless, while views are
+only added once their watermark is moved.
+*/
+func rollupSlug(rc *redis.Client, slug string, to int) error {
+	from, err := rollupWatermark(rc, slug)
+	if err != nil || to <= from {
+		return err
+	}
+	// uniques are far more recent than page views, so don't
+	// walk all the way back to the epoch on the first rollup
+	uvFrom := from
+	if uvFrom < to-UniqueRollupLookback {
+		uvFrom = to - UniqueRollupLookback
+	}
+	err = rollupUniques(slug, uvFrom, to)
+	if err != nil {
+		return fmt.Errorf("error rolling up uniques: %v", err)
+	}
+	return rollupViews(slug, to)
+}
+
+/*
+Add page views for one day directly onto the rollups for a page, or the
+site if slug is empty, using rc so the increments can be queued in a
+transaction.
+*/
+func addToRollups(rc *redis.Client, slug string, bucket int, views int) error {
+	for _, period := range RollupPeriods {
+		label, err := PeriodLabel(period, bucket)
+		if err != nil {
+			return err
+		}
+		err = rc.Cmd("ZINCRBY", rollupKey(period, slug), views, label).Err
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove per-page daily detail for days up to and including cutoff.
+func pruneDaily(slug string, cutoff int) error {
+	key := fmt.Sprintf(PageViewPageBucket, slug)
+	counts, err := dailyCounts(key)
+	if err != nil {
+		return err
+	}
+	rc, err := GetRedisClient()
+	defer PutRedisClient(rc)
+	if err != nil {
+		return err
+	}
+	for bucket := range counts {
+		if bucket > cutoff {
+			continue
+		}
+		err := rc.Cmd("ZREM", key, bucket).Err
+		if err != nil {
+			return err
+		}
+		err = rc.Cmd("DEL", fmt.Sprintf(PageUniqueVisitorBucket, bucket, slug)).Err
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Roll completed days up into weekly, monthly and yearly buckets and
+prune per-page daily detail older than the retention period.
+
+Days are only rolled up once, tracked by a watermark for the site
+and for each page which moves along with its rollups, while
+RollupWatermark only moves once everything is rolled up. Detail is
+only pruned once it's behind RollupWatermark, so the rollups always
+sum to the totals in analytics.pv. If another process is
+already rolling up, this returns without doing anything.
+*/
+func Rollup() error {
+	rc, err := GetRedisClient()
+	defer PutRedisClient(rc)
+	if err != nil {
+		return err
+	}
+	resp := rc.Cmd("SET", RollupLock, CurrentTimestamp(), "NX", "EX", RollupLockExpire)
+	if resp.Err != nil {
+		return resp.Err
+	}
+	if resp.IsType(redis.Nil) {
+		return nil
+	}
+	defer rc.Cmd("DEL", RollupLock)
+
+	err = checkTimezone(rc)
+	if err != nil {
+		return err
+	}
+
+	from, _, err := getWatermark(rc, RollupWatermark)
+	if err != nil {
+		return err
+	}
+	// never roll up today, since it is still accumulating views
+	to := timebucket(DaySeconds) - 1
+	slugs, err := rc.Cmd("ZRANGE", PageViews, 0, -1).List()
+	if err != nil {
+		return err
+	}
+
+	if to > from {
+		err = rollupSlug(rc, "", to)
+		if err != nil {
+			return fmt.Errorf("error rolling up site: %v", err)
+		}
+		for _, slug := range slugs {
+			err := rollupSlug(rc, slug, to)
+			if err != nil {
+				return fmt.Errorf("error rolling up %v: %v", slug, err)
+			}
+		}
+		err = rc.Cmd("SET", RollupWatermark, to).Err
+		if err != nil {
+			return err
+		}
+		from = to
+	}
+
+	if retentionDays != 0 {
+		cutoff := timebucket(DaySeconds) - retentionDays
+		if cutoff > from {
+			cutoff = from
+		}
+		for _, slug := range slugs {
+			err := pruneDaily(slug, cutoff)
+			if err != nil {
+				return fmt.Errorf("error pruning %v: %v", slug, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Run Rollup every rollupPeriod seconds, forever.
+func RunRollups() {
+	for {
+		err := Rollup()
+		if err != nil {
+			log.Printf("error rolling up analytics: %v", err)
+		}
+		time.Sleep(time.Duration(rollupPeriod) * time.Second)
+	}
+}
+
+// Page views and estimated unique visitors for one week, month or year.
+type PeriodStats struct {
+	Label     string
+	PageViews int
+	Uniques   int
+}
+
+/*
+Retrieve rolled up page views and unique visitors for a period,
+most recent first, for up to count periods. An empty slug returns
+the site-wide numbers.
+*/
+func RollupStats(slug string, period string, count int) ([]*PeriodStats, error) {
+	if _, err := PeriodLabel(period, 0); err != nil {
+		return []*PeriodStats{}, err
+	}
+	rc, err := GetRedisClient()
+	defer PutRedisClient(rc)
+	if err != nil {
+		return []*PeriodStats{}, err
+	}
+	key := fmt.Sprintf(PageViewRollup, period)
+	if slug != "" {
+		key = fmt.Sprintf(PageViewPageRollup, period, slug)
+	}
+	raw, err := rc.Cmd("ZRANGE", key, 0, -1, "WITHSCORES").List()
+	if err != nil {
+		return []*PeriodStats{}, err
+	}
+	views := make(map[string]int, len(raw)/2)
+	labels := make([]string, 0, len(raw)/2)
+	for i := 0; i+1 < len(raw); i += 2 {
+		pv, err := strconv.ParseFloat(raw[i+1], 64)
+		if err != nil {
+			return []*PeriodStats{}, err
+		}
+		views[raw[i]] = int(pv)
+		labels = append(labels, raw[i])
+	}
+	// labels sort lexicographically in time order
+	sort.Sort(sort.Reverse(sort.StringSlice(labels)))
+
+	stats := []*PeriodStats{}
+	for _, label := range labels {
+		if len(stats) >= count {
+			break
+		}
+		ps := &PeriodStats{Label: label, PageViews: views[label]}
+		uvKey := fmt.Sprintf(UniqueVisitorRollup, period, ps.Label)
+		if slug != "" {
+			uvKey = fmt.Sprintf(PageUniqueVisitorRollup, period, ps.Label, slug)
+		}
+		ps.Uniques, err = rc.Cmd("PFCOUNT", uvKey).Int()
+		if err != nil {
+			return stats, err
+		}
+		stats = append(stats, ps)
+	}
+	return stats, nil
+}
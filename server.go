@@ -30,6 +30,15 @@ func buildSidebar(cfg *Config, p *Page) (map[string]interface{}, error) {
 		trending = []*Page{}
 	}
 	params["Trending"] = trending
+	// each window sums every page's daily detail, so rather than building
+	// all of them per request only the default window is in the sidebar,
+	// and the others are at /list/popular/<window>/
+	popular, err := PopularPages(DefaultPopularWindow, 0, PagesInModules)
+	if err != nil {
+		log.Printf("error generating popular pages for %v: %v", DefaultPopularWindow, err)
+		popular = []*Page{}
+	}
+	params["Popular"] = map[string][]*Page{DefaultPopularWindow: popular}
 	if p != nil && !p.Draft {
 		previous, err := Surrounding(p, 2, true)
 		if err != nil {
@@ -51,10 +60,26 @@ func buildSidebar(cfg *Config, p *Page) (map[string]interface{}, error) {
 			similar = []*Page{}
 		}
 		params["Similar"] = similar
+
+		alsoRead, err := AlsoReadPages(p, 0, PagesInModules)
+		if err != nil {
+			log.Printf("error generating also read pages: %v", err)
+			alsoRead = []*Page{}
+		}
+		params["AlsoRead"] = alsoRead
+
+		backlinks, err := Backlinks(p, 0, PagesInModules)
+		if err != nil {
+			log.Printf("error generating backlinks: %v", err)
+			backlinks = []*Page{}
+		}
+		params["Backlinks"] = backlinks
 	} else {
 		params["Previous"] = []*Page{}
 		params["Following"] = []*Page{}
 		params["Similar"] = []*Page{}
+		params["AlsoRead"] = []*Page{}
+		params["Backlinks"] = []*Page{}
 	}
 	return params, nil
 }
@@ -67,14 +92,21 @@ func defaultParams(cfg *Config, p *Page, r *http.Request) (map[string]interface{
 	params["Cfg"] = cfg
 	params["Page"] = p
 	params["Path"] = r.URL.Path[1:]
-	params["Now"] = time.Now()
+	params["Now"] = SiteTime(time.Now())
 	params["Query"] = ""
+	params["AskConsent"] = AskConsent(r)
 	return params, nil
 }
 
 func makeTagHandler(cfg *Config) http.HandlerFunc {
 	handle := func(w http.ResponseWriter, r *http.Request) {
 		tag := getSlug(r)[5:]
+		// popular pages for the tag are at /tags/<tag>/popular/<window>/
+		if parts := strings.SplitN(tag, "/popular/", 2); len(parts) == 2 {
+			popularHandler := makePopularHandler(cfg, parts[0], parts[1])
+			popularHandler(w, r)
+			return
+		}
 		list := fmt.Sprintf(TagPagesZsetByTrend, tag)
 		tagHandler := makeListHandler(cfg, list, fmt.Sprintf("Pages for %v Tag", tag))
 		tagHandler(w, r)
@@ -82,6 +114,44 @@ func makeTagHandler(cfg *Config) http.HandlerFunc {
 	return handle
 }
 
+// Build http.HandlerFunc for most viewed pages over a window, optionally within a tag.
+func makePopularHandler(cfg *Config, tag string, window string) http.HandlerFunc {
+	handle := func(w http.ResponseWriter, r *http.Request) {
+		if window == "" {
+			window = DefaultPopularWindow
+		}
+		if _, err := popularWindowDays(window); err != nil {
+			notFoundPage(w, r, cfg, err)
+			return
+		}
+		title := popularTitles[window]
+		var list string
+		var err error
+		if tag == "" {
+			list, err = PopularList(window)
+		} else {
+			list, err = TagPopularList(tag, window)
+			title = fmt.Sprintf("%v in %v", title, tag)
+		}
+		if err != nil {
+			errorPage(w, r, cfg, nil, err)
+			return
+		}
+		listHandler := makeListHandler(cfg, list, title)
+		listHandler(w, r)
+	}
+	return handle
+}
+
+func makePopularListHandler(cfg *Config) http.HandlerFunc {
+	handle := func(w http.ResponseWriter, r *http.Request) {
+		window := strings.TrimPrefix(getSlug(r), "list/popular")
+		popularHandler := makePopularHandler(cfg, "", strings.Trim(window, "/"))
+		popularHandler(w, r)
+	}
+	return handle
+}
+
 func makeTagsHandler(cfg *Config, title string) http.HandlerFunc {
 	tagHandler := makeTagHandler(cfg)
 
@@ -119,6 +189,11 @@ func makeTagsHandler(cfg *Config, title string) http.HandlerFunc {
 
 func makeFeedsHandler(cfg *Config) http.HandlerFunc {
 	handle := func(w http.ResponseWriter, r *http.Request) {
+		// there's only the one feed, so anything else under it isn't found
+		if strings.Trim(r.URL.Path, "/") != SiteFeed {
+			notFoundPage(w, r, cfg, fmt.Errorf("no feed at %v", r.URL.Path))
+			return
+		}
 		pgs, err := PagesForList(PageZsetByTime, 0, cfg.Blog.ResultsPerPage, true)
 		if err != nil {
 			errorPage(w, r, cfg, nil, err)
@@ -135,6 +210,10 @@ func makeFeedsHandler(cfg *Config) http.HandlerFunc {
 			return
 		}
 		fmt.Fprint(w, atom)
+		err = TrackFeedFetch(SiteFeed, r)
+		if err != nil {
+			log.Printf("error tracking feed fetch: %v", err)
+		}
 	}
 	return handle
 }
@@ -242,6 +321,12 @@ func makePageHandler(cfg *Config, indexHandler http.HandlerFunc) http.HandlerFun
 			}
 			return
 		}
+		if trackOutbound {
+			p.Content = RewriteOutboundLinks(cfg, p)
+		}
+		if !p.Draft {
+			EnsureSession(w, r)
+		}
 		params, err := defaultParams(cfg, p, r)
 		if err != nil {
 			errorPage(w, r, cfg, p, err)
@@ -267,8 +352,10 @@ func errorPage(w http.ResponseWriter, r *http.Request, cfg *Config, p *Page, err
 		"Previous":  []*Page{},
 		"Following": []*Page{},
 		"Similar":   []*Page{},
+		"AlsoRead":  []*Page{},
 		"Recent":    []*Page{},
 		"Trending":  []*Page{},
+		"Popular":   map[string][]*Page{},
 		"Cfg":       cfg,
 		"Path":      r.URL.Path[1:],
 		"Query":     "",
@@ -308,19 +395,69 @@ func Serve(cfg *Config) {
 	if err != nil {
 		log.Fatalf("failed configuring redis: %v", err)
 	}
+	err = ConfigTimezone(cfg)
+	if err != nil {
+		log.Fatalf("failed configuring timezone: %v", err)
+	}
+	err = InitTimezone()
+	if err != nil {
+		log.Fatalf("failed recording timezone: %v", err)
+	}
+	err = ConfigAnalytics(cfg)
+	if err != nil {
+		log.Fatalf("failed configuring analytics: %v", err)
+	}
+	err = ConfigRollups(cfg)
+	if err != nil {
+		log.Fatalf("failed configuring rollups: %v", err)
+	}
+	err = ConfigPrivacy(cfg)
+	if err != nil {
+		log.Fatalf("failed configuring privacy: %v", err)
+	}
+	err = ConfigGeoIP(cfg)
+	if err != nil {
+		log.Fatalf("failed configuring geoip: %v", err)
+	}
+	err = ConfigReferrerSpam(cfg)
+	if err != nil {
+		log.Fatalf("failed configuring referrer spam: %v", err)
+	}
+	err = ConfigSessions(cfg)
+	if err != nil {
+		log.Fatalf("failed configuring sessions: %v", err)
+	}
+	err = ConfigOutbound(cfg)
+	if err != nil {
+		log.Fatalf("failed configuring outbound links: %v", err)
+	}
+	err = ConfigMarkdown(cfg)
+	if err != nil {
+		log.Fatalf("failed configuring markdown: %v", err)
+	}
 	err = ConfigSearch(cfg)
 	if err != nil {
 		log.Fatalf("failed configuring search: %v", err)
 	}
 
+	go RunRollups()
+	if cfg.Analytics.VerifyReferrers {
+		go RunReferrerVerification()
+	}
+
 	recentHandler := makeListHandler(cfg, PageZsetByTime, "Recent Pages")
 
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir(cfg.Blog.StaticDir))))
 	http.HandleFunc("/list/trending/", makeListHandler(cfg, PageZsetByTrend, "Popular Pages"))
 	http.HandleFunc("/list/recent/", recentHandler)
+	http.HandleFunc("/list/popular/", makePopularListHandler(cfg))
 	http.HandleFunc("/tags/", makeTagsHandler(cfg, "Tags By Page Count"))
-	http.HandleFunc("/feeds/", makeFeedsHandler(cfg))
-	http.HandleFunc("/search/", makeSearchHandler(cfg))
+	http.HandleFunc("/feeds/", rateLimited(cfg, "feeds", makeFeedsHandler(cfg)))
+	http.HandleFunc("/search/", rateLimited(cfg, "search", makeSearchHandler(cfg)))
+	http.HandleFunc(OutboundPath, makeOutboundHandler(cfg))
+	http.HandleFunc(BeaconPath, makeBeaconHandler(cfg))
+	http.HandleFunc(ConsentPath, makeConsentHandler(cfg))
+	http.HandleFunc(LivePath, makeLiveHandler(cfg))
 	http.HandleFunc("/", makePageHandler(cfg, recentHandler))
 	http.ListenAndServe(cfg.Server.Loc, nil)
 }
@@ -0,0 +1,240 @@
+// Shortcodes for embedding figures, videos, gists and so on in pages.
+package icarus
+
+import (
+	"fmt"
+	"html"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+Render a shortcode to HTML. Arguments are given as key="value", or
+positionally as "0", "1" and so on, and inner is the rendered Markdown
+between the opening and closing tags of paired shortcodes.
+*/
+type Shortcode func(args map[string]string, inner string) (string, error)
+
+var Shortcodes = map[string]Shortcode{
+	"figure":  figureShortcode,
+	"youtube": youtubeShortcode,
+	"vimeo":   vimeoShortcode,
+	"gist":    gistShortcode,
+	"tweet":   tweetShortcode,
+	"note":    calloutShortcode("note"),
+	"warning": calloutShortcode("warning"),
+}
+
+// Add a shortcode, replacing any existing shortcode with the same name.
+func RegisterShortcode(name string, sc Shortcode) {
+	Shortcodes[name] = sc
+}
+
+// Shortcodes look like {{< name arg="value" >}}, and {{</* name */>}} is left as-is.
+var shortcodeTag = regexp.MustCompile(`\{\{<\s*(/?)\s*([\w-]+)((?:\s+(?:[\w-]+=)?(?:"[^"]*"|'[^']*'|[^\s"'>]+))*)\s*>\}\}`)
+var shortcodeComment = regexp.MustCompile(`\{\{<\s*/\*(.*?)\*/\s*>\}\}`)
+var shortcodeArg = regexp.MustCompile(`(?:([\w-]+)=)?("[^"]*"|'[^']*'|[^\s"'>]+)`)
+var shortcodeID = regexp.MustCompile(`^[\w-]+$`)
+
+const shortcodePlaceholder = "ICARUSSHORTCODE%vEND"
+
+var shortcodePlaceholders = regexp.MustCompile(`<p>ICARUSSHORTCODE(\d+)END</p>\n?|ICARUSSHORTCODE(\d+)END`)
+
+func parseShortcodeArgs(s string) map[string]string {
+	args := make(map[string]string)
+	pos := 0
+	for _, m := range shortcodeArg.FindAllStringSubmatch(s, -1) {
+		value := m[2]
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') {
+			value = value[1 : len(value)-1]
+		}
+		if m[1] != "" {
+			args[m[1]] = value
+		} else {
+			args[strconv.Itoa(pos)] = value
+			pos += 1
+		}
+	}
+	return args
+}
+
+// Retrieve a named argument, or the positional one at pos.
+func shortcodeArgument(args map[string]string, name string, pos int) string {
+	if v, ok := args[name]; ok {
+		return v
+	}
+	return args[strconv.Itoa(pos)]
+}
+
+/*
+Replace shortcodes with placeholders, rendering each to HTML which
+placeShortcodes swaps in once the page is rendered. The contents of
+paired shortcodes are rendered as fragments of the page. Shortcodes in code
+are left alone.
+*/
+func expandShortcodes(ctx *RenderContext, content string) (string, error) {
+	masked := maskCode(content)
+	tags := shortcodeTag.FindAllStringSubmatchIndex(masked, -1)
+	var out []string
+	last := 0
+	for i := 0; i < len(tags); i++ {
+		tag := tags[i]
+		closing := masked[tag[2]:tag[3]] == "/"
+		name := masked[tag[4]:tag[5]]
+		line, _ := position(content, tag[0])
+		line += ctx.BodyLine
+		if closing {
+			return "", fmt.Errorf("closing shortcode %q on line %v has no opening shortcode", name, line)
+		}
+		sc, ok := Shortcodes[name]
+		if !ok {
+			return "", fmt.Errorf("unknown shortcode %q on line %v", name, line)
+		}
+		args := parseShortcodeArgs(masked[tag[6]:tag[7]])
+
+		// find the matching closing tag, if there is one
+		end, inner := tag[1], ""
+		depth := 0
+		for j := i + 1; j < len(tags); j++ {
+			other := tags[j]
+			if masked[other[4]:other[5]] != name {
+				continue
+			}
+			if masked[other[2]:other[3]] != "/" {
+				depth += 1
+			} else if depth > 0 {
+				depth -= 1
+			} else {
+				// contents are rendered as part of the page, so heading
+				// ids are shared and errors have the file's line numbers
+				innerLine, _ := position(content, tag[1])
+				bodyLine := ctx.BodyLine
+				ctx.BodyLine = bodyLine + innerLine - 1
+				rendered, err := renderMarkdownFragment(ctx, content[tag[1]:other[0]])
+				ctx.BodyLine = bodyLine
+				if err != nil {
+					return "", fmt.Errorf("error rendering shortcode %q on line %v: %v", name, line, err)
+				}
+				end, inner = other[1], rendered
+				i = j
+				break
+			}
+		}
+		rendered, err := sc(args, inner)
+		if err != nil {
+			return "", fmt.Errorf("error in shortcode %q on line %v: %v", name, line, err)
+		}
+		out = append(out, content[last:tag[0]], fmt.Sprintf(shortcodePlaceholder, len(ctx.shortcodes)))
+		ctx.shortcodes = append(ctx.shortcodes, rendered)
+		last = end
+	}
+	out = append(out, content[last:])
+	content = strings.Join(out, "")
+	return shortcodeComment.ReplaceAllString(content, "{{<$1>}}"), nil
+}
+
+/*
+Swap shortcode placeholders for their HTML, repeating for shortcodes
+nested in the contents of others.
+*/
+func placeShortcodes(ctx *RenderContext, content string) (string, error) {
+	for n := 0; n <= len(ctx.shortcodes) && shortcodePlaceholders.MatchString(content); n++ {
+		content = shortcodePlaceholders.ReplaceAllStringFunc(content, func(s string) string {
+			m := shortcodePlaceholders.FindStringSubmatch(s)
+			i, _ := strconv.Atoi(m[1] + m[2])
+			if i >= len(ctx.shortcodes) {
+				return s
+			}
+			return ctx.shortcodes[i]
+		})
+	}
+	return content, nil
+}
+
+// {{< figure src="/static/a.png" alt="..." caption="..." link="..." >}}
+func figureShortcode(args map[string]string, inner string) (string, error) {
+	src := shortcodeArgument(args, "src", 0)
+	if src == "" {
+		return "", fmt.Errorf("figure needs a src")
+	}
+	img := fmt.Sprintf(`<img src="%v" alt="%v">`, html.EscapeString(src), html.EscapeString(args["alt"]))
+	if link := args["link"]; link != "" {
+		img = fmt.Sprintf(`<a href="%v">%v</a>`, html.EscapeString(link), img)
+	}
+	caption := ""
+	if c := args["caption"]; c != "" {
+		caption = fmt.Sprintf("<figcaption>%v</figcaption>", html.EscapeString(c))
+	} else if inner != "" {
+		caption = fmt.Sprintf("<figcaption>%v</figcaption>", strings.TrimSpace(inner))
+	}
+	return fmt.Sprintf("<figure>%v%v</figure>\n", img, caption), nil
+}
+
+func videoEmbed(src string, title string) string {
+	return fmt.Sprintf(`<div class="video-embed"><iframe src="%v" title="%v" frameborder="0" loading="lazy" allowfullscreen></iframe></div>`+"\n", src, html.EscapeString(title))
+}
+
+// {{< youtube dQw4w9WgXcQ >}}, embedded without YouTube's tracking cookies.
+func youtubeShortcode(args map[string]string, inner string) (string, error) {
+	id := shortcodeArgument(args, "id", 0)
+	if !shortcodeID.MatchString(id) {
+		return "", fmt.Errorf("youtube needs a video id, not %q", id)
+	}
+	return videoEmbed("https://www.youtube-nocookie.com/embed/"+id, args["title"]), nil
+}
+
+// {{< vimeo 76979871 >}}
+func vimeoShortcode(args map[string]string, inner string) (string, error) {
+	id := shortcodeArgument(args, "id", 0)
+	if !shortcodeID.MatchString(id) {
+		return "", fmt.Errorf("vimeo needs a video id, not %q", id)
+	}
+	return videoEmbed("https://player.vimeo.com/video/"+id+"?dnt=1", args["title"]), nil
+}
+
+// {{< gist lethain 1234abcd file="example.go" >}}
+func gistShortcode(args map[string]string, inner string) (string, error) {
+	user, id := shortcodeArgument(args, "user", 0), shortcodeArgument(args, "id", 1)
+	if !shortcodeID.MatchString(user) || !shortcodeID.MatchString(id) {
+		return "", fmt.Errorf("gist needs a user and id, not %q and %q", user, id)
+	}
+	src := fmt.Sprintf("https://gist.github.com/%v/%v.js", user, id)
+	if file := args["file"]; file != "" {
+		src += "?file=" + url.QueryEscape(file)
+	}
+	return fmt.Sprintf(`<script src="%v"></script>`+"\n", src), nil
+}
+
+/*
+{{< tweet user="lethain" id="123" date="May 19, 2016" >}}The tweet's text{{< /tweet >}}
+
+Tweets are quoted rather than embedded, so they don't load Twitter's scripts.
+*/
+func tweetShortcode(args map[string]string, inner string) (string, error) {
+	user, id := shortcodeArgument(args, "user", 0), shortcodeArgument(args, "id", 1)
+	if !shortcodeID.MatchString(user) || !shortcodeID.MatchString(id) {
+		return "", fmt.Errorf("tweet needs a user and id, not %q and %q", user, id)
+	}
+	if strings.TrimSpace(inner) == "" {
+		return "", fmt.Errorf("tweet needs the tweet's text between {{< tweet >}} and {{< /tweet >}}")
+	}
+	date := args["date"]
+	if date == "" {
+		date = "view on Twitter"
+	}
+	return fmt.Sprintf(`<blockquote class="tweet">%v<p class="tweet-source">&mdash; @%v, <a href="https://twitter.com/%v/status/%v">%v</a></p></blockquote>`+"\n",
+		strings.TrimSpace(inner), user, user, id, html.EscapeString(date)), nil
+}
+
+// {{< note title="..." >}}Markdown{{< /note >}}, and the same for warning.
+func calloutShortcode(kind string) Shortcode {
+	return func(args map[string]string, inner string) (string, error) {
+		title := ""
+		if t := args["title"]; t != "" {
+			title = fmt.Sprintf(`<p class="callout-title">%v</p>`, html.EscapeString(t))
+		}
+		return fmt.Sprintf(`<div class="callout callout-%v">%v%v</div>`+"\n", kind, title, strings.TrimSpace(inner)), nil
+	}
+}
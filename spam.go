@@ -0,0 +1,377 @@
+// Keeping referrer spam out of the referrer sets.
+package icarus
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const ReferrerSpam = "analytics.refer_spam"
+const ReferrerVerified = "analytics.refer_verified"
+const ReferrerPending = "analytics.refer_pending"
+const ReferrerPendingPages = "analytics.refer_pending.%v"
+const ReferrerAttempts = "analytics.refer_attempts"
+const ReferrerBurst = "analytics.refer_burst.%v"
+
+// Unverified referrers sending more views than this in a minute are spam.
+const ReferrerBurstLimit = 60
+const ReferrerVerifyAttempts = 3
+const ReferrerVerifyPeriod = 60 * 5
+const ReferrerVerifyTimeout = 10 * time.Second
+const ReferrerVerifyMaxBytes = 1 << 20
+
+var blockedReferrers = map[string]bool{}
+var verifyReferrers = false
+var siteDomain = ""
+
+/*
+Load the referrer blocklist, a file with one domain per line, with
+blank lines and lines starting with # ignored.
+*/
+func LoadReferrerBlocklist(path string) (map[string]bool, error) {
+	blocked := make(map[string]bool)
+	f, err := os.Open(path)
+	if err != nil {
+		return blocked, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		blocked[line] = true
+	}
+	return blocked, scanner.Err()
+}
+
+func ConfigReferrerSpam(cfg *Config) error {
+	siteDomain = strings.ToLower(cfg.Server.Domain)
+	verifyReferrers = cfg.Analytics.VerifyReferrers
+	if cfg.Analytics.ReferrerBlocklist == "" {
+		return nil
+	}
+	blocked, err := LoadReferrerBlocklist(cfg.Analytics.ReferrerBlocklist)
+	if err != nil {
+		return fmt.Errorf("failed loading referrer blocklist: %v", err)
+	}
+	blockedReferrers = blocked
+	return nil
+}
+
+// Check the referrer, or any domain it is a subdomain of, is blocklisted.
+func IsBlockedReferrer(referrer string) bool {
+	host := strings.ToLower(referrer)
+	for host != "" {
+		if blockedReferrers[host] {
+			return true
+		}
+		i := strings.Index(host, ".")
+		if i == -1 {
+			break
+		}
+		host = host[i+1:]
+	}
+	return false
+}
+
+/*
+Check if a referrer is trusted without any checks: direct traffic,
+well-known sites, this site itself and the bucket of campaign sources
+past their limit. Campaign sources come from whoever wrote the link,
+so they aren't trusted.
+*/
+func isTrustedReferrer(referrer string) bool {
+	switch ReferrerClass(referrer) {
+	case "direct", "search", "aggregator", "social":
+		return true
+	}
+	return referrer == OtherCampaign || isSiteHost(referrer, siteDomain)
+}
+
+/*
+Record a view's referrer, unless it looks like spam.
+
+Blocklisted referrers are dropped, as are untrusted referrers which
+burst past ReferrerBurstLimit views in a minute. If VerifyReferrers
+is set, untrusted referrers other than campaign sources, which have
+no page to link back from, are held as pending until
+VerifyPendingReferrers confirms they link back to this site.
+*/
+func TrackReferrer(p *Page, referrer string, r *http.Request) error {
+	if IsBlockedReferrer(referrer) {
+		return nil
+	}
+	rc, err := GetRedisClient()
+	defer PutRedisClient(rc)
+	if err != nil {
+		return err
+	}
+	trusted := isTrustedReferrer(referrer)
+	if !trusted {
+		spam, err := rc.Cmd("SISMEMBER", ReferrerSpam, referrer).Int()
+		if err != nil || spam == 1 {
+			return err
+		}
+		verified, err := rc.Cmd("SISMEMBER", ReferrerVerified, referrer).Int()
+		if err != nil {
+			return err
+		}
+		trusted = verified == 1
+	}
+	if !trusted {
+		burstKey := fmt.Sprintf(ReferrerBurst, referrer)
+		views, err := rc.Cmd("INCR", burstKey).Int()
+		if err != nil {
+			return err
+		}
+		if views == 1 {
+			err := rc.Cmd("EXPIRE", burstKey, 60).Err
+			if err != nil {
+				return err
+			}
+		}
+		if views > ReferrerBurstLimit {
+			log.Printf("marking %v as referrer spam after %v views in a minute", referrer, views)
+			return MarkReferrerSpam(referrer)
+		}
+		if verifyReferrers && ReferrerClass(referrer) != "campaign" {
+			err := rc.Cmd("HSETNX", ReferrerPending, referrer, r.Referer()).Err
+			if err != nil {
+				return err
+			}
+			return rc.Cmd("ZINCRBY", fmt.Sprintf(ReferrerPendingPages, referrer), 1, p.Slug).Err
+		}
+	}
+	referKeys := []string{
+		Referrers,
+		fmt.Sprintf(PageReferrers, p.Slug),
+	}
+	for _, key := range referKeys {
+		err := rc.Cmd("ZINCRBY", key, 1, referrer).Err
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check the IP is one we shouldn't make requests to on a referrer's behalf.
+func isPrivateIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return true
+	}
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7"} {
+		_, block, _ := net.ParseCIDR(cidr)
+		if block.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Refuse to connect to private addresses, including after redirects.
+var verifyClient = &http.Client{
+	Timeout: ReferrerVerifyTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: ReferrerVerifyTimeout,
+			Control: func(network string, address string, c syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				ip := net.ParseIP(host)
+				if ip == nil || isPrivateIP(ip) {
+					return fmt.Errorf("refusing to verify referrer at private address %v", host)
+				}
+				return nil
+			},
+		}).DialContext,
+	},
+}
+
+// Fetch a referring page and check it links back to this site.
+func linksBack(referer string) (bool, error) {
+	u, err := url.Parse(referer)
+	if err != nil {
+		return false, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return false, fmt.Errorf("can't verify %v referer", u.Scheme)
+	}
+	resp, err := verifyClient.Get(u.String())
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, ReferrerVerifyMaxBytes))
+	if err != nil {
+		return false, err
+	}
+	return strings.Contains(strings.ToLower(string(body)), siteDomain), nil
+}
+
+// Mark a referrer as spam and drop any views held for it.
+func MarkReferrerSpam(referrer string) error {
+	rc, err := GetRedisClient()
+	defer PutRedisClient(rc)
+	if err != nil {
+		return err
+	}
+	err = rc.Cmd("SADD", ReferrerSpam, referrer).Err
+	if err != nil {
+		return err
+	}
+	err = rc.Cmd("HDEL", ReferrerPending, referrer).Err
+	if err != nil {
+		return err
+	}
+	err = rc.Cmd("HDEL", ReferrerAttempts, referrer).Err
+	if err != nil {
+		return err
+	}
+	return rc.Cmd("DEL", fmt.Sprintf(ReferrerPendingPages, referrer)).Err
+}
+
+// Mark a referrer as verified, moving its held views into the referrer sets.
+func markReferrerVerified(referrer string) error {
+	rc, err := GetRedisClient()
+	defer PutRedisClient(rc)
+	if err != nil {
+		return err
+	}
+	err = rc.Cmd("SADD", ReferrerVerified, referrer).Err
+	if err != nil {
+		return err
+	}
+	pending, err := TopCounts(fmt.Sprintf(ReferrerPendingPages, referrer), -1)
+	if err != nil {
+		return err
+	}
+	for _, page := range pending {
+		err := rc.Cmd("ZINCRBY", Referrers, page.Count, referrer).Err
+		if err != nil {
+			return err
+		}
+		err = rc.Cmd("ZINCRBY", fmt.Sprintf(PageReferrers, page.Key), page.Count, referrer).Err
+		if err != nil {
+			return err
+		}
+	}
+	err = rc.Cmd("HDEL", ReferrerPending, referrer).Err
+	if err != nil {
+		return err
+	}
+	err = rc.Cmd("HDEL", ReferrerAttempts, referrer).Err
+	if err != nil {
+		return err
+	}
+	return rc.Cmd("DEL", fmt.Sprintf(ReferrerPendingPages, referrer)).Err
+}
+
+/*
+Check each pending referrer links back to this site, marking it
+verified if it does and as spam if it doesn't. Referrers which can't
+be fetched are retried, and marked as spam after ReferrerVerifyAttempts.
+*/
+func VerifyPendingReferrers() error {
+	rc, err := GetRedisClient()
+	defer PutRedisClient(rc)
+	if err != nil {
+		return err
+	}
+	pending, err := rc.Cmd("HGETALL", ReferrerPending).Map()
+	if err != nil {
+		return err
+	}
+	for referrer, referer := range pending {
+		ok, err := linksBack(referer)
+		if err != nil {
+			attempts, herr := rc.Cmd("HINCRBY", ReferrerAttempts, referrer, 1).Int()
+			if herr != nil {
+				return herr
+			}
+			log.Printf("failed verifying referrer %v (attempt %v): %v", referrer, attempts, err)
+			if attempts < ReferrerVerifyAttempts {
+				continue
+			}
+		}
+		if ok {
+			err = markReferrerVerified(referrer)
+		} else {
+			log.Printf("marking %v as referrer spam since %v doesn't link back", referrer, referer)
+			err = MarkReferrerSpam(referrer)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run VerifyPendingReferrers every ReferrerVerifyPeriod seconds, forever.
+func RunReferrerVerification() {
+	for {
+		err := VerifyPendingReferrers()
+		if err != nil {
+			log.Printf("error verifying referrers: %v", err)
+		}
+		time.Sleep(ReferrerVerifyPeriod * time.Second)
+	}
+}
+
+/*
+Remove blocklisted and spam referrers from the referrer sets,
+returning the referrers which were purged.
+*/
+func PurgeSpamReferrers() ([]string, error) {
+	purged := []string{}
+	rc, err := GetRedisClient()
+	defer PutRedisClient(rc)
+	if err != nil {
+		return purged, err
+	}
+	referrers, err := rc.Cmd("ZRANGE", Referrers, 0, -1).List()
+	if err != nil {
+		return purged, err
+	}
+	for _, referrer := range referrers {
+		spam, err := rc.Cmd("SISMEMBER", ReferrerSpam, referrer).Int()
+		if err != nil {
+			return purged, err
+		}
+		if spam == 1 || IsBlockedReferrer(referrer) {
+			purged = append(purged, referrer)
+		}
+	}
+	if len(purged) == 0 {
+		return purged, nil
+	}
+	err = rc.Cmd("ZREM", Referrers, purged).Err
+	if err != nil {
+		return purged, err
+	}
+	slugs, err := rc.Cmd("ZRANGE", PageViews, 0, -1).List()
+	if err != nil {
+		return purged, err
+	}
+	for _, slug := range slugs {
+		err := rc.Cmd("ZREM", fmt.Sprintf(PageReferrers, slug), purged).Err
+		if err != nil {
+			return purged, err
+		}
+	}
+	return purged, nil
+}
@@ -0,0 +1,50 @@
+// Report how far down a page the reader scrolled and how long they
+// spent reading it, once, when they leave the page.
+(function() {
+  var script = document.currentScript || document.getElementById("beacon");
+  var slug = script.getAttribute("data-slug");
+  var post = document.querySelector(".blog-post:last-of-type") || document.body;
+  var maxDepth = 0;
+  var engaged = 0;
+  var lastActive = Date.now();
+  var sent = false;
+
+  function measure() {
+    var rect = post.getBoundingClientRect();
+    var seen = window.innerHeight - rect.top;
+    var depth = rect.height > 0 ? Math.round(100 * seen / rect.height) : 100;
+    maxDepth = Math.max(maxDepth, Math.min(100, Math.max(0, depth)));
+    lastActive = Date.now();
+  }
+
+  // count a second as engaged if the page is visible and the reader
+  // has scrolled or moved within the last 30 seconds
+  setInterval(function() {
+    if (document.visibilityState === "visible" && Date.now() - lastActive < 30000) {
+      engaged += 1;
+    }
+  }, 1000);
+
+  function send() {
+    if (sent || !navigator.sendBeacon) {
+      return;
+    }
+    sent = true;
+    var data = new URLSearchParams();
+    data.set("slug", slug);
+    data.set("depth", maxDepth);
+    data.set("seconds", engaged);
+    navigator.sendBeacon("/beacon/", data);
+  }
+
+  ["scroll", "mousemove", "keydown", "touchstart"].forEach(function(evt) {
+    window.addEventListener(evt, measure, {passive: true});
+  });
+  document.addEventListener("visibilitychange", function() {
+    if (document.visibilityState === "hidden") {
+      send();
+    }
+  });
+  window.addEventListener("pagehide", send);
+  measure();
+})();
@@ -0,0 +1,217 @@
+// Estimating feed subscribers from feed fetches.
+package icarus
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mediocregopher/radix.v2/redis"
+)
+
+const FeedFetches = "analytics.feed_fetch.%v"
+const FeedAggregators = "analytics.feed_aggregator.%v.%v"
+const FeedFetchers = "analytics.feed_ip.%v.%v"
+const FeedClaimants = "analytics.feed_claimant.%v.%v"
+const FeedDetailDays = 400
+const FeedDetailExpire = DaySeconds * FeedDetailDays
+
+// The name fetches of the site's feed, served at /feeds/, are tracked under.
+const SiteFeed = "feeds"
+
+// Reported subscriber counts above this are assumed to be bogus and capped.
+const MaxFeedSubscribers = 100000
+
+// Limits feed fetch tracking to one fetch per IP per RateLimitPeriod by default.
+var feedFetchLimiter = NewRateLimiter("feed_fetch", RateLimitConfig{})
+
+// Keep the highest count an aggregator reports, atomically.
+const maxSubscribersScript = `local prev = tonumber(redis.call("hget", KEYS[1], ARGV[1]) or "0")
+if tonumber(ARGV[2]) > prev then
+    redis.call("hset", KEYS[1], ARGV[1], ARGV[2])
+end
+redis.call("expire", KEYS[1], ARGV[3])
+return 0
+`
+
+var maxSubscribersScriptSHA = scriptSHA(maxSubscribersScript)
+
+// Aggregators report subscribers like "Feedly/1.0 (...; 12 subscribers; feed-id=...)".
+var subscriberCount = regexp.MustCompile(`(?i)(\d+)\s+(subscribers?|readers?)`)
+var aggregatorFeedID = regexp.MustCompile(`(?i)feed-?id=([^;)\s]+)`)
+
+/*
+Parse a feed reader's user agent for a subscriber count.
+
+Returns the aggregator (its product name, plus its feed id when it
+reports one, since the same aggregator may fetch several copies of
+a feed) and its subscribers, or ok false if there is no count.
+*/
+func ParseSubscribers(ua string) (aggregator string, subscribers int, ok bool) {
+	match := subscriberCount.FindStringSubmatch(ua)
+	if match == nil {
+		return "", 0, false
+	}
+	subscribers, err := strconv.Atoi(match[1])
+	if err != nil {
+		return "", 0, false
+	}
+	aggregator = strings.TrimSpace(ua)
+	if i := strings.IndexAny(aggregator, "/ ("); i > 0 {
+		aggregator = aggregator[:i]
+	}
+	aggregator = strings.ToLower(aggregator)
+	if id := aggregatorFeedID.FindStringSubmatch(ua); id != nil {
+		aggregator = aggregator + "#" + id[1]
+	}
+	return aggregator, subscribers, true
+}
+
+/*
+Record a fetch of a feed.
+
+Aggregators which report subscriber counts are recorded with the
+highest count they report each day, and everyone else is counted
+once per day by their (anonymized) IP.
+
+Since anyone can claim to be an aggregator, fetches are rate limited
+by IP, each IP can only speak for one aggregator a day, and counts
+are capped at MaxFeedSubscribers.
+*/
+func TrackFeedFetch(feed string, r *http.Request) error {
+	if OptedOut(r) {
+		return nil
+	}
+	if feedFetchLimiter.Limited(fmt.Sprintf(RateLimitKey, feedFetchLimiter.Name, RateLimitIP(r))) {
+		return nil
+	}
+	ip := AnonymizedIP(r)
+	rc, err := GetRedisClient()
+	defer PutRedisClient(rc)
+	if err != nil {
+		return err
+	}
+	bucket := timebucket(DaySeconds)
+	fetchesKey := fmt.Sprintf(FeedFetches, feed)
+	fetches, err := rc.Cmd("ZINCRBY", fetchesKey, 1, bucket).Float64()
+	if err != nil {
+		return err
+	}
+	if fetches == 1 {
+		// the first fetch of the day drops days past FeedDetailDays
+		err := trimFeedFetches(rc, fetchesKey, bucket-FeedDetailDays)
+		if err != nil {
+			return err
+		}
+	}
+	err = rc.Cmd("EXPIRE", fetchesKey, FeedDetailExpire).Err
+	if err != nil {
+		return err
+	}
+	if aggregator, subscribers, ok := ParseSubscribers(r.UserAgent()); ok {
+		claimants := fmt.Sprintf(FeedClaimants, feed, bucket)
+		err := rc.Cmd("HSETNX", claimants, ip, aggregator).Err
+		if err != nil {
+			return err
+		}
+		err = rc.Cmd("EXPIRE", claimants, 2*DaySeconds).Err
+		if err != nil {
+			return err
+		}
+		claimed, err := rc.Cmd("HGET", claimants, ip).Str()
+		if err != nil || claimed != aggregator {
+			return err
+		}
+		if subscribers > MaxFeedSubscribers {
+			subscribers = MaxFeedSubscribers
+		}
+		key := fmt.Sprintf(FeedAggregators, feed, bucket)
+		return runScript(rc, maxSubscribersScript, maxSubscribersScriptSHA, 1, key, aggregator, subscribers, FeedDetailExpire).Err
+	}
+	key := fmt.Sprintf(FeedFetchers, feed, bucket)
+	err = rc.Cmd("PFADD", key, ip).Err
+	if err != nil {
+		return err
+	}
+	return rc.Cmd("EXPIRE", key, FeedDetailExpire).Err
+}
+
+// Remove days up to and including cutoff from a feed's daily fetch counts.
+func trimFeedFetches(rc *redis.Client, key string, cutoff int) error {
+	buckets, err := rc.Cmd("ZRANGE", key, 0, -1).List()
+	if err != nil {
+		return err
+	}
+	old := []string{}
+	for _, raw := range buckets {
+		bucket, err := strconv.Atoi(raw)
+		if err == nil && bucket <= cutoff {
+			old = append(old, raw)
+		}
+	}
+	if len(old) == 0 {
+		return nil
+	}
+	return rc.Cmd("ZREM", key, old).Err
+}
+
+// Fetches and estimated subscribers for a feed on one day.
+type FeedStats struct {
+	Bucket     int
+	Fetches    int
+	Aggregated int
+	Direct     int
+}
+
+// Subscribers via aggregators plus readers fetching the feed themselves.
+func (fs *FeedStats) Estimate() int {
+	return fs.Aggregated + fs.Direct
+}
+
+func (fs *FeedStats) Date() time.Time {
+	return BucketDate(fs.Bucket)
+}
+
+// Retrieve daily subscriber estimates for a feed for the trailing number of days, oldest first.
+func FeedSubscribers(feed string, days int) ([]*FeedStats, error) {
+	rc, err := GetRedisClient()
+	defer PutRedisClient(rc)
+	if err != nil {
+		return []*FeedStats{}, err
+	}
+	today := timebucket(DaySeconds)
+	stats := make([]*FeedStats, 0, days)
+	for bucket := today - days + 1; bucket <= today; bucket++ {
+		fs := &FeedStats{Bucket: bucket}
+		resp := rc.Cmd("ZSCORE", fmt.Sprintf(FeedFetches, feed), bucket)
+		if !resp.IsType(redis.Nil) {
+			fetches, err := resp.Float64()
+			if err != nil {
+				return stats, err
+			}
+			fs.Fetches = int(fetches)
+		}
+		aggregators, err := rc.Cmd("HGETALL", fmt.Sprintf(FeedAggregators, feed, bucket)).Map()
+		if err != nil {
+			return stats, err
+		}
+		for aggregator, raw := range aggregators {
+			subscribers, err := strconv.Atoi(raw)
+			if err != nil {
+				log.Printf("skipping malformed subscribers for %v: %v", aggregator, err)
+				continue
+			}
+			fs.Aggregated += subscribers
+		}
+		fs.Direct, err = rc.Cmd("PFCOUNT", fmt.Sprintf(FeedFetchers, feed, bucket)).Int()
+		if err != nil {
+			return stats, err
+		}
+		stats = append(stats, fs)
+	}
+	return stats, nil
+}
@@ -0,0 +1,98 @@
+// Summaries, word counts and reading times computed from rendered pages.
+package icarus
+
+import (
+	"html"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Generated summaries are cut to about this many characters.
+const SummaryLength = 250
+const WordsPerMinute = 200
+
+var elementTag = regexp.MustCompile(`(?is)<(/?)([a-z][a-z0-9]*)\b[^>]*?(/?)>`)
+
+// Elements without closing tags, which don't nest anything.
+var voidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true,
+	"hr": true, "img": true, "input": true, "link": true, "meta": true,
+	"source": true, "track": true, "wbr": true,
+}
+
+/*
+The contents of the paragraphs which aren't nested in other elements,
+so quotes, figures and asides aren't taken as the page's own words.
+*/
+func topLevelParagraphs(content string) []string {
+	paragraphs := []string{}
+	depth, start := 0, -1
+	for _, m := range elementTag.FindAllStringSubmatchIndex(content, -1) {
+		name := strings.ToLower(content[m[4]:m[5]])
+		if voidElements[name] || m[7] > m[6] {
+			continue
+		}
+		if m[3] > m[2] {
+			if depth > 0 {
+				depth--
+			}
+			if depth == 0 && name == "p" && start >= 0 {
+				paragraphs = append(paragraphs, content[start:m[0]])
+				start = -1
+			}
+			continue
+		}
+		if depth == 0 && name == "p" {
+			start = m[1]
+		}
+		depth++
+	}
+	return paragraphs
+}
+
+// The text of some HTML, with tags removed and whitespace collapsed.
+func htmlText(s string) string {
+	text := html.UnescapeString(htmlTag.ReplaceAllString(s, " "))
+	return strings.Join(strings.Fields(text), " ")
+}
+
+// Cut text to at most length characters, on a word boundary.
+func truncateWords(text string, length int) string {
+	if utf8.RuneCountInString(text) <= length {
+		return text
+	}
+	cut := string([]rune(text)[:length])
+	if i := strings.LastIndex(cut, " "); i > 0 {
+		cut = cut[:i]
+	}
+	return strings.TrimRight(cut, " ,.;:") + "…"
+}
+
+/*
+Build a summary from the first top-level paragraph of the page's content,
+escaped so it can be used in templates the same as an author's summary.
+*/
+func SummarizeContent(content string) string {
+	for _, paragraph := range topLevelParagraphs(content) {
+		if text := htmlText(paragraph); text != "" {
+			return html.EscapeString(truncateWords(text, SummaryLength))
+		}
+	}
+	return html.EscapeString(truncateWords(htmlText(content), SummaryLength))
+}
+
+/*
+Fill in the page's word count and reading time, and its summary if
+the author didn't write one.
+*/
+func (p *Page) Summarize() {
+	p.WordCount = len(strings.Fields(htmlText(p.Content)))
+	p.ReadingTime = (p.WordCount + WordsPerMinute - 1) / WordsPerMinute
+	if p.ReadingTime == 0 {
+		p.ReadingTime = 1
+	}
+	if strings.TrimSpace(p.Summary) == "" {
+		p.Summary = SummarizeContent(p.Content)
+	}
+}
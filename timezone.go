@@ -0,0 +1,238 @@
+// Applying the site's timezone to dates and analytics day buckets.
+package icarus
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/mediocregopher/radix.v2/redis"
+)
+
+// The timezone analytics buckets are currently recorded in.
+const AnalyticsTimezone = "analytics.timezone"
+
+// Analytics were bucketed by UTC day before the timezone was configurable.
+const LegacyTimezone = "UTC"
+
+var siteLocation = time.UTC
+
+func ConfigTimezone(cfg *Config) error {
+	if cfg.Blog.Timezone == "" {
+		siteLocation = time.UTC
+		return nil
+	}
+	loc, err := time.LoadLocation(cfg.Blog.Timezone)
+	if err != nil {
+		return fmt.Errorf("unknown timezone %v: %v", cfg.Blog.Timezone, err)
+	}
+	siteLocation = loc
+	return nil
+}
+
+// Convert a time into the site's timezone.
+func SiteTime(t time.Time) time.Time {
+	return t.In(siteLocation)
+}
+
+// Day bucket for a time, counting days since the epoch in loc.
+func dayBucket(t time.Time, loc *time.Location) int {
+	_, offset := t.In(loc).Zone()
+	return int((t.Unix() + int64(offset)) / DaySeconds)
+}
+
+// Midnight, in the site's timezone, of the day a bucket represents.
+func BucketDate(bucket int) time.Time {
+	t := time.Unix(int64(bucket)*DaySeconds, 0).UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, siteLocation)
+}
+
+/*
+Retrieve the timezone analytics are currently bucketed in.
+
+Analytics recorded before the timezone was stored are in
+LegacyTimezone, unless no days have been recorded yet, in which case
+there's nothing to migrate and the configured timezone is stored.
+*/
+func storedTimezone(rc *redis.Client) (string, error) {
+	resp := rc.Cmd("GET", AnalyticsTimezone)
+	if !resp.IsType(redis.Nil) {
+		return resp.Str()
+	}
+	days, err := rc.Cmd("ZCARD", PageViewBucket).Int()
+	if err != nil {
+		return "", err
+	}
+	if days > 0 {
+		return LegacyTimezone, nil
+	}
+	err = rc.Cmd("SET", AnalyticsTimezone, siteLocation.String(), "NX").Err
+	if err != nil {
+		return "", err
+	}
+	return rc.Cmd("GET", AnalyticsTimezone).Str()
+}
+
+/*
+Record the configured timezone if nothing has been recorded yet, so a
+new install starts out bucketing in it rather than needing a migration.
+Call once Redis and the timezone are configured, before tracking views.
+*/
+func InitTimezone() error {
+	rc, err := GetRedisClient()
+	defer PutRedisClient(rc)
+	if err != nil {
+		return err
+	}
+	_, err = storedTimezone(rc)
+	return err
+}
+
+// Check analytics are bucketed in the configured timezone.
+func checkTimezone(rc *redis.Client) error {
+	stored, err := storedTimezone(rc)
+	if err != nil {
+		return err
+	}
+	if stored != siteLocation.String() {
+		return fmt.Errorf("analytics are bucketed in %v but configured for %v, run ianalytics migrate-timezone", stored, siteLocation)
+	}
+	return nil
+}
+
+/*
+Migrate analytics to the configured timezone.
+
+Existing day buckets can't be split by hour, so days before the
+migration stay as they were recorded. If the new timezone is behind
+the old one, today may be a day which has already been rolled up,
+so days after the new yesterday are taken back out of the rollups
+to be rolled up again once they're over. Unique visitors can't be
+taken back out, so their rollups for those periods are rebuilt from
+the days before.
+*/
+func MigrateTimezone() error {
+	rc, err := GetRedisClient()
+	defer PutRedisClient(rc)
+	if err != nil {
+		return err
+	}
+	stored, err := storedTimezone(rc)
+	if err != nil {
+		return err
+	}
+	if stored == siteLocation.String() {
+		log.Printf("analytics are already bucketed in %v", stored)
+		return nil
+	}
+
+	yesterday := dayBucket(time.Now(), siteLocation) - 1
+	slugs, err := rc.Cmd("ZRANGE", PageViews, 0, -1).List()
+	if err != nil {
+		return err
+	}
+	for _, slug := range append([]string{""}, slugs...) {
+		watermark, err := rollupWatermark(rc, slug)
+		if err != nil {
+			return err
+		}
+		if watermark <= yesterday {
+			continue
+		}
+		dailyKey := PageViewBucket
+		if slug != "" {
+			dailyKey = fmt.Sprintf(PageViewPageBucket, slug)
+		}
+		for bucket := yesterday + 1; bucket <= watermark; bucket++ {
+			resp := rc.Cmd("ZSCORE", dailyKey, bucket)
+			if resp.IsType(redis.Nil) {
+				continue
+			}
+			views, err := resp.Float64()
+			if err != nil {
+				return err
+			}
+			err = addToRollups(rc, slug, bucket, -int(views))
+			if err != nil {
+				return err
+			}
+			if slug == "" {
+				log.Printf("un-rolled up %v so it is rolled up again in %v", BucketDate(bucket).Format("2006-01-02"), siteLocation)
+			}
+		}
+		for bucket := yesterday + 1; bucket <= watermark; bucket++ {
+			err = rebuildUniqueRollups(rc, slug, bucket, yesterday)
+			if err != nil {
+				return err
+			}
+		}
+		err = rc.Cmd("SET", rollupWatermarkKey(slug), yesterday).Err
+		if err != nil {
+			return err
+		}
+	}
+	watermark, _, err := getWatermark(rc, RollupWatermark)
+	if err != nil {
+		return err
+	}
+	if watermark > yesterday {
+		err = rc.Cmd("SET", RollupWatermark, yesterday).Err
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("migrated analytics from %v to %v", stored, siteLocation)
+	return rc.Cmd("SET", AnalyticsTimezone, siteLocation.String()).Err
+}
+
+/*
+Rebuild the unique visitor rollups of the periods containing bucket,
+for a page or the site if slug is empty, from the daily HyperLogLogs
+up to and including through. Pages whose daily detail for a period
+has been pruned keep their rollup as it was.
+*/
+func rebuildUniqueRollups(rc *redis.Client, slug string, bucket int, through int) error {
+	for _, period := range RollupPeriods {
+		label, err := PeriodLabel(period, bucket)
+		if err != nil {
+			return err
+		}
+		first := bucket
+		for {
+			previous, err := PeriodLabel(period, first-1)
+			if err != nil {
+				return err
+			}
+			if previous != label {
+				break
+			}
+			first--
+		}
+		if slug != "" && retentionDays != 0 && first <= timebucket(DaySeconds)-retentionDays {
+			continue
+		}
+		key := fmt.Sprintf(UniqueVisitorRollup, period, label)
+		if slug != "" {
+			key = fmt.Sprintf(PageUniqueVisitorRollup, period, label, slug)
+		}
+		days := []string{}
+		for day := first; day <= through; day++ {
+			if slug == "" {
+				days = append(days, fmt.Sprintf(UniqueVisitorBucket, day))
+			} else {
+				days = append(days, fmt.Sprintf(PageUniqueVisitorBucket, day, slug))
+			}
+		}
+		err = rc.Cmd("DEL", key).Err
+		if err != nil {
+			return err
+		}
+		if len(days) > 0 {
+			err = rc.Cmd("PFMERGE", key, days).Err
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
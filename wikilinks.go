@@ -0,0 +1,91 @@
+// Wiki-style links between pages, written as [[slug]] or [[slug|text]].
+package icarus
+
+import (
+	"fmt"
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var wikiLink = regexp.MustCompile(`\[\[([^\[\]|\n]+)(?:\|([^\[\]\n]+))?\]\]`)
+
+/*
+Titles of pages wiki links can point at by slug, besides those in Redis,
+so pages rendered together can link to each other. Pages found in Redis
+are added as they're looked up. Each run of rendering pages gets its
+own, and it isn't safe to share between goroutines.
+*/
+type WikiPages map[string]string
+
+// Make a page available to wiki links before it's loaded into Redis.
+func (w WikiPages) Add(slug string, title string) {
+	w[slug] = title
+}
+
+// Find the title of the page with the slug, and whether it exists.
+func (w WikiPages) title(slug string) (string, bool, error) {
+	if title, ok := w[slug]; ok {
+		return title, true, nil
+	}
+	if redisPool == nil {
+		return "", false, fmt.Errorf("redis isn't configured")
+	}
+	p, err := PageFromRedis(slug)
+	if _, ok := err.(*NoSuchPagesError); ok {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	if w != nil {
+		w[slug] = p.Title
+	}
+	return p.Title, true, nil
+}
+
+// The slug a wiki link names, so [[My Page]] links to my-page.
+func wikiSlug(name string) string {
+	return strings.Join(strings.Fields(strings.ToLower(name)), "-")
+}
+
+/*
+Replace wiki links with links to the pages they name, using each page's
+title unless the link has its own text, either of which is escaped
+rather than treated as HTML. Links to slugs without a page
+are marked with the wikilink-missing class and recorded as broken, and
+links which couldn't be checked, because Redis couldn't be reached, are
+marked with wikilink-unverified and recorded as unverified. Wiki links
+in code are left alone.
+*/
+func expandWikiLinks(ctx *RenderContext, content string) (string, error) {
+	masked := maskCode(content)
+	var out []string
+	last := 0
+	for _, m := range wikiLink.FindAllStringSubmatchIndex(masked, -1) {
+		name := strings.TrimSpace(content[m[2]:m[3]])
+		slug := wikiSlug(name)
+		text := name
+		if m[4] != -1 {
+			text = strings.TrimSpace(content[m[4]:m[5]])
+		}
+		line, _ := position(content, m[0])
+		line += ctx.BodyLine
+		class := "wikilink"
+		title, found, err := ctx.WikiPages.title(slug)
+		if err != nil {
+			class = "wikilink wikilink-unverified"
+			ctx.unverifiedLinks = append(ctx.unverifiedLinks, fmt.Sprintf("%v (line %v): %v", slug, line, err))
+		} else if !found {
+			class = "wikilink wikilink-missing"
+			ctx.brokenLinks = append(ctx.brokenLinks, fmt.Sprintf("%v (line %v)", slug, line))
+		} else if m[4] == -1 && title != "" {
+			text = title
+		}
+		href := (&url.URL{Path: "/" + slug + "/"}).EscapedPath()
+		out = append(out, content[last:m[0]], fmt.Sprintf(`<a class="%v" href="%v">%v</a>`, class, html.EscapeString(href), html.EscapeString(text)))
+		last = m[1]
+	}
+	out = append(out, content[last:])
+	return strings.Join(out, ""), nil
+}